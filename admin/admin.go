@@ -0,0 +1,264 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the settings of the admin API.
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// the address the admin API listens on, e.g. 127.0.0.1:9001, or the path
+	// of a Unix socket prefixed with "unix:", e.g. unix:/var/run/yalp.sock.
+	Address string `yaml:"address"`
+	// the bearer token every admin request must carry. It defaults to the
+	// YALP_ADMIN_TOKEN environment variable.
+	Token string `yaml:"token"`
+}
+
+// TokenEnv is the environment variable that holds the admin token when the
+// config does not set one.
+const TokenEnv = "YALP_ADMIN_TOKEN"
+
+// sampleToken is the placeholder token of the old sample config. It is
+// refused like an empty token, since anyone can guess it.
+const sampleToken = "change-me"
+
+// Manager is implemented by the balancers whose backends can be changed at
+// runtime. All the methods must be safe to call while serving traffic.
+type Manager interface {
+	BackendStatuses() []backend.Status
+	// NewBackend constructs a backend whose lifetime is bound to the manager.
+	NewBackend(options backend.Options) (backend.Backend, error)
+	AddBackend(b backend.Backend)
+	RemoveBackend(id uuid.UUID) error
+	SetBackendState(id uuid.UUID, state backend.AdminState) error
+}
+
+const (
+	backendsPath = "/api/backends"
+	healthPath   = "/api/health"
+	configPath   = "/api/config"
+)
+
+type handler struct {
+	manager       Manager
+	token         string
+	runningConfig func() interface{}
+}
+
+// NewHandler returns the handler of the admin API. Every request must carry
+// the token in an "Authorization: Bearer <token>" header, except for the
+// status page served on /. runningConfig returns the configuration Yalp is
+// running with, it must not contain any secret.
+//
+//	GET    /                              serves the status page
+//	GET    /api/dashboard                 returns the data of the status page
+//	GET    /api/health                    summarizes the health of the backends
+//	GET    /api/config                    returns the running configuration as YAML
+//	GET    /api/backends                  lists the backends
+//	POST   /api/backends                  adds a backend, e.g. {"url": "http://10.0.0.1", "weight": 1}
+//	GET    /api/backends/{id}             inspects a backend
+//	DELETE /api/backends/{id}             removes a backend
+//	POST   /api/backends/{id}/drain       stops sending new sessions to a backend
+//	POST   /api/backends/{id}/maintenance stops sending any request to a backend
+//	POST   /api/backends/{id}/activate    puts a backend back into rotation
+//	GET    /api/canaries                  lists the traffic splits of the routes
+//	POST   /api/canaries/{route}          changes the share of a canary, e.g. {"percent": 5}
+//	GET    /api/mirrors                   compares the routes with their shadow pools
+//	GET    /api/queues                    lists the requests waiting for a backend of every pool
+func NewHandler(manager Manager, token string, runningConfig func() interface{}) (http.Handler, error) {
+	if token == "" {
+		return nil, errors.New("the admin API requires a token, set admin.token or " + TokenEnv)
+	}
+	if token == sampleToken {
+		return nil, errors.New("the admin API cannot use the sample token " + sampleToken)
+	}
+	return &handler{manager: manager, token: token, runningConfig: runningConfig}, nil
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == dashboardPageURL && req.Method == http.MethodGet {
+		serveDashboardPage(w)
+		return
+	}
+	if !h.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="yalp"`)
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+		return
+	}
+
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if path == healthPath || path == configPath || path == dashboardPath {
+		if req.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		switch path {
+		case healthPath:
+			writeJSON(w, http.StatusOK, NewHealth(h.manager.BackendStatuses()))
+		case configPath:
+			h.getConfig(w)
+		default:
+			writeJSON(w, http.StatusOK, h.dashboard())
+		}
+		return
+	}
+
+	if path == canariesPath || strings.HasPrefix(path, canariesPath+"/") {
+		h.canaries(w, req, strings.TrimPrefix(strings.TrimPrefix(path, canariesPath), "/"))
+		return
+	}
+
+	if path == mirrorsPath {
+		h.mirrors(w, req)
+		return
+	}
+
+	if path == queuesPath {
+		h.queues(w, req)
+		return
+	}
+
+	if path == backendsPath {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, h.manager.BackendStatuses())
+		case http.MethodPost:
+			h.addBackend(w, req)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	if !strings.HasPrefix(path, backendsPath+"/") {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(path, backendsPath+"/"), "/")
+	id, err := uuid.Parse(parts[0])
+	if err != nil || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	if len(parts) == 1 {
+		switch req.Method {
+		case http.MethodGet:
+			h.getBackend(w, id)
+		case http.MethodDelete:
+			if err := h.manager.RemoveBackend(id); err != nil {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var state backend.AdminState
+	switch parts[1] {
+	case "drain":
+		state = backend.StateDraining
+	case "maintenance":
+		state = backend.StateMaintenance
+	case "activate":
+		state = backend.StateActive
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if err := h.manager.SetBackendState(id, state); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	h.getBackend(w, id)
+}
+
+func (h *handler) authorized(req *http.Request) bool {
+	const prefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	token := strings.TrimPrefix(header, prefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *handler) addBackend(w http.ResponseWriter, req *http.Request) {
+	body := backend.Options{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if parsed, err := url.Parse(body.URL); err != nil || parsed.Host == "" ||
+		(parsed.Scheme != "http" && parsed.Scheme != "https") {
+		writeError(w, http.StatusBadRequest, errors.New("the url must be an absolute http or https url"))
+		return
+	}
+	if body.Weight < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("the weight cannot be negative"))
+		return
+	}
+
+	b, err := h.manager.NewBackend(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	h.manager.AddBackend(b)
+	writeJSON(w, http.StatusCreated, b.Status())
+}
+
+func (h *handler) getBackend(w http.ResponseWriter, id uuid.UUID) {
+	for _, status := range h.manager.BackendStatuses() {
+		if status.ID == id {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, errors.New("did not find a backend with the given id: "+id.String()))
+}
+
+func (h *handler) getConfig(w http.ResponseWriter) {
+	if h.runningConfig == nil {
+		writeError(w, http.StatusNotFound, errors.New("the running configuration is not available"))
+		return
+	}
+	out, err := yaml.Marshal(h.runningConfig())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(out)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
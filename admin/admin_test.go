@@ -0,0 +1,236 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+)
+
+type fakeManager struct {
+	backends []backend.Backend
+	sync.Mutex
+}
+
+func (m *fakeManager) BackendStatuses() []backend.Status {
+	m.Lock()
+	defer m.Unlock()
+	statuses := make([]backend.Status, 0)
+	for _, b := range m.backends {
+		statuses = append(statuses, b.Status())
+	}
+	return statuses
+}
+
+func (m *fakeManager) NewBackend(options backend.Options) (backend.Backend, error) {
+	return backend.NewBackendWithOptions(context.Background(), options)
+}
+
+func (m *fakeManager) AddBackend(b backend.Backend) {
+	m.Lock()
+	defer m.Unlock()
+	m.backends = append(m.backends, b)
+}
+
+func (m *fakeManager) RemoveBackend(id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	for i, b := range m.backends {
+		if b.ID() == id {
+			m.backends = append(m.backends[:i], m.backends[i+1:]...)
+			b.Close()
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (m *fakeManager) SetBackendState(id uuid.UUID, state backend.AdminState) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, b := range m.backends {
+		if b.ID() == id {
+			b.SetState(state)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func doRequest(t *testing.T, server *httptest.Server, method string, path string, token string, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestRequiresToken(t *testing.T) {
+	handler, err := NewHandler(&fakeManager{}, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		resp := doRequest(t, server, http.MethodGet, "/api/backends", token, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected 401 for token %q, received %d", token, resp.StatusCode)
+		}
+	}
+
+	for _, token := range []string{"", sampleToken} {
+		if _, err := NewHandler(&fakeManager{}, token, nil); err == nil {
+			t.Errorf("expected an error for the token %q", token)
+		}
+	}
+}
+
+func TestManageBackends(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+
+	manager := &fakeManager{}
+	handler, _ := NewHandler(manager, "secret", nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp := doRequest(t, server, http.MethodPost, "/api/backends", "secret", `{"url": "`+testServer.URL+`", "weight": 3, "zone": "eu-west-1a", "tags": {"version": "2"}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, received %d", resp.StatusCode)
+	}
+	added := backend.Status{}
+	_ = json.NewDecoder(resp.Body).Decode(&added)
+	resp.Body.Close()
+	if added.URL != testServer.URL || added.Weight != 3 || added.State != "active" ||
+		added.Zone != "eu-west-1a" || added.Tags["version"] != "2" {
+		t.Errorf("unexpected status of the added backend: %+v", added)
+	}
+
+	resp = doRequest(t, server, http.MethodPost, "/api/backends/"+added.ID.String()+"/drain", "secret", "")
+	drained := backend.Status{}
+	_ = json.NewDecoder(resp.Body).Decode(&drained)
+	resp.Body.Close()
+	if drained.State != "draining" {
+		t.Errorf("expected the backend to be draining, found %q", drained.State)
+	}
+
+	resp = doRequest(t, server, http.MethodGet, "/api/backends", "secret", "")
+	statuses := make([]backend.Status, 0)
+	_ = json.NewDecoder(resp.Body).Decode(&statuses)
+	resp.Body.Close()
+	if len(statuses) != 1 || statuses[0].State != "draining" {
+		t.Errorf("expected one draining backend, found %+v", statuses)
+	}
+
+	resp = doRequest(t, server, http.MethodDelete, "/api/backends/"+added.ID.String(), "secret", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204, received %d", resp.StatusCode)
+	}
+	resp = doRequest(t, server, http.MethodGet, "/api/backends/"+added.ID.String(), "secret", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a removed backend, received %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, server, http.MethodPost, "/api/backends", "secret", `{"url": "not a url"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid url, received %d", resp.StatusCode)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+	b, err := backend.NewBackend(context.Background(), testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.RecordRequest(false, 10*time.Millisecond)
+	b.RecordRequest(true, 20*time.Millisecond)
+
+	handler, _ := NewHandler(&fakeManager{backends: []backend.Backend{b}}, "secret", nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp := doRequest(t, server, http.MethodGet, "/", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("expected the status page to be served without a token, received %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, server, http.MethodGet, "/api/dashboard", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the dashboard data to require the token, received %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, server, http.MethodGet, "/api/dashboard", "secret", "")
+	dashboard := Dashboard{}
+	_ = json.NewDecoder(resp.Body).Decode(&dashboard)
+	resp.Body.Close()
+	if len(dashboard.Pools) != 1 || len(dashboard.Pools[0].Backends) != 1 {
+		t.Fatalf("expected one pool with one backend, found %+v", dashboard)
+	}
+	status := dashboard.Pools[0].Backends[0]
+	// the moving average moves a fifth of the way towards the second latency.
+	if status.Requests != 2 || status.Errors != 1 || status.ErrorRate != 0.5 || status.Latency != 12 || status.Circuit != "closed" {
+		t.Errorf("unexpected traffic stats: %+v", status)
+	}
+}
+
+// poolsManager is a fakeManager whose backends belong to pools.
+type poolsManager struct {
+	fakeManager
+	statuses []backend.Status
+}
+
+func (m *poolsManager) BackendStatuses() []backend.Status {
+	return m.statuses
+}
+
+func TestDashboardGroupsPools(t *testing.T) {
+	manager := &poolsManager{statuses: []backend.Status{
+		{ID: uuid.New(), Pool: "default", Alive: true},
+		{ID: uuid.New(), Pool: "api", Alive: false},
+		{ID: uuid.New(), Pool: "default", Alive: true},
+	}}
+	handler, _ := NewHandler(manager, "secret", nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp := doRequest(t, server, http.MethodGet, "/api/dashboard", "secret", "")
+	dashboard := Dashboard{}
+	_ = json.NewDecoder(resp.Body).Decode(&dashboard)
+	resp.Body.Close()
+	if len(dashboard.Pools) != 2 {
+		t.Fatalf("expected two pools, found %+v", dashboard)
+	}
+	if pool := dashboard.Pools[0]; pool.Name != "default" || len(pool.Backends) != 2 || pool.Health.Status != Healthy {
+		t.Errorf("expected the default pool to have two healthy backends, found %+v", pool)
+	}
+	if pool := dashboard.Pools[1]; pool.Name != "api" || len(pool.Backends) != 1 || pool.Health.Status != Unhealthy {
+		t.Errorf("expected the api pool to have one dead backend, found %+v", pool)
+	}
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const canariesPath = "/api/canaries"
+
+// CanaryManager is implemented by the managers whose routes can send a share
+// of their traffic to a canary pool.
+type CanaryManager interface {
+	Canaries() []CanaryStatus
+	// SetCanaryPercent changes the percentage of the requests of the route
+	// that are sent to its canary pool.
+	SetCanaryPercent(route string, percent float64) error
+}
+
+// CanaryStatus is a snapshot of the traffic split of a route.
+type CanaryStatus struct {
+	Route   string  `json:"route"`
+	Percent float64 `json:"percent"`
+	Sticky  bool    `json:"sticky"`
+	// the primary variant comes first.
+	Variants []VariantStatus `json:"variants"`
+}
+
+// VariantStatus counts the requests served by one side of a traffic split.
+type VariantStatus struct {
+	Name     string `json:"name"`
+	Pool     string `json:"pool"`
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+	// the fraction of the requests that failed since Yalp started.
+	ErrorRate float64 `json:"error_rate"`
+	// the requests sent to the variant by an override.
+	Overridden uint64 `json:"overridden"`
+}
+
+type canaryRequest struct {
+	Percent *float64 `json:"percent"`
+}
+
+// canaries serves the canary endpoints, route is empty for the list.
+func (h *handler) canaries(w http.ResponseWriter, req *http.Request, route string) {
+	manager, ok := h.manager.(CanaryManager)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("the balancer does not split traffic"))
+		return
+	}
+	if route == "" {
+		if req.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		writeJSON(w, http.StatusOK, manager.Canaries())
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	body := canaryRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Percent == nil || *body.Percent < 0 || *body.Percent > 100 {
+		writeError(w, http.StatusBadRequest, errors.New("the percent must be between 0 and 100"))
+		return
+	}
+	if err := manager.SetCanaryPercent(route, *body.Percent); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	for _, status := range manager.Canaries() {
+		if status.Route == route {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package admin
+
+import (
+	_ "embed"
+	"net/http"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+)
+
+//go:embed dashboard/index.html
+var dashboardPage []byte
+
+const (
+	dashboardPath    = "/api/dashboard"
+	defaultPoolName  = "default"
+	dashboardPageURL = "/"
+)
+
+// Dashboard is the data shown by the status page.
+type Dashboard struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Pools       []PoolStatus `json:"pools"`
+}
+
+// PoolStatus is the state of a group of backends.
+type PoolStatus struct {
+	Name     string           `json:"name"`
+	Health   Health           `json:"health"`
+	Backends []backend.Status `json:"backends"`
+}
+
+// dashboard groups the backends by pool, in the order the manager lists
+// them. The backends without a pool belong to the default one.
+func (h *handler) dashboard() Dashboard {
+	pools := make([]PoolStatus, 0)
+	index := map[string]int{}
+	for _, status := range h.manager.BackendStatuses() {
+		name := status.Pool
+		if name == "" {
+			name = defaultPoolName
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(pools)
+			index[name] = i
+			pools = append(pools, PoolStatus{Name: name})
+		}
+		pools[i].Backends = append(pools[i].Backends, status)
+	}
+	for i := range pools {
+		pools[i].Health = NewHealth(pools[i].Backends)
+	}
+	return Dashboard{GeneratedAt: time.Now(), Pools: pools}
+}
+
+// serveDashboardPage serves the status page. The page itself contains no
+// data, it asks for the admin token and polls /api/dashboard with it.
+func serveDashboardPage(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	_, _ = w.Write(dashboardPage)
+}
@@ -0,0 +1,42 @@
+package admin
+
+import "github.com/alidn/Yalp/backend"
+
+// The overall health states reported by the admin API.
+const (
+	Healthy   = "healthy"
+	Degraded  = "degraded"
+	Unhealthy = "unhealthy"
+)
+
+// Health summarizes the health of the backends that are not in maintenance.
+type Health struct {
+	Status string `json:"status"`
+	Alive  int    `json:"alive"`
+	Total  int    `json:"total"`
+}
+
+// NewHealth computes the Health of the given backends. Yalp is healthy if
+// every backend is alive, degraded if only some of them are, and unhealthy
+// if none of them is.
+func NewHealth(statuses []backend.Status) Health {
+	health := Health{}
+	for _, status := range statuses {
+		if status.State == backend.StateMaintenance.String() {
+			continue
+		}
+		health.Total++
+		if status.Alive {
+			health.Alive++
+		}
+	}
+	switch {
+	case health.Alive == 0:
+		health.Status = Unhealthy
+	case health.Alive < health.Total:
+		health.Status = Degraded
+	default:
+		health.Status = Healthy
+	}
+	return health
+}
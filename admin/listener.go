@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// SplitAddress returns the network and the address to use with net.Dial or
+// net.Listen for an admin address, which is either a TCP address or the path
+// of a Unix socket prefixed with "unix:".
+func SplitAddress(address string) (string, string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		return "unix", strings.TrimPrefix(address, unixPrefix)
+	}
+	return "tcp", address
+}
+
+// Listen listens on the given admin address. A stale Unix socket left by a
+// previous run is removed first.
+func Listen(address string) (net.Listener, error) {
+	network, addr := SplitAddress(address)
+	if network == "unix" {
+		if _, err := os.Stat(addr); err == nil {
+			if conn, err := net.Dial("unix", addr); err == nil {
+				// another process is still serving on the socket.
+				conn.Close()
+			} else {
+				_ = os.Remove(addr)
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+)
+
+const mirrorsPath = "/api/mirrors"
+
+// MirrorManager is implemented by the managers whose routes can mirror their
+// traffic to a shadow pool.
+type MirrorManager interface {
+	Mirrors() []MirrorStatus
+}
+
+// MirrorStatus compares the responses of a route with the ones of its shadow
+// pool.
+type MirrorStatus struct {
+	Route   string  `json:"route"`
+	Pool    string  `json:"pool"`
+	Percent float64 `json:"percent"`
+	// the requests sent to the shadow pool.
+	Mirrored uint64 `json:"mirrored"`
+	// the sampled requests that were not mirrored, because their body was
+	// too large or too many copies were in flight.
+	Skipped uint64 `json:"skipped"`
+	// the copies whose status differs from the one sent to the client.
+	StatusMismatches uint64 `json:"status_mismatches"`
+	// the copies that failed or got a 5xx.
+	ShadowErrors uint64 `json:"shadow_errors"`
+	// the average response times of the route and of the shadow pool for the
+	// mirrored requests, in milliseconds.
+	Latency       float64 `json:"latency"`
+	ShadowLatency float64 `json:"shadow_latency"`
+}
+
+func (h *handler) mirrors(w http.ResponseWriter, req *http.Request) {
+	manager, ok := h.manager.(MirrorManager)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("the balancer does not mirror traffic"))
+		return
+	}
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, manager.Mirrors())
+}
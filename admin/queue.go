@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+)
+
+const queuesPath = "/api/queues"
+
+// QueueManager is implemented by the managers whose requests can wait for a
+// backend below its max connections.
+type QueueManager interface {
+	Queues() []QueueStatus
+}
+
+// QueueStatus describes the queue of the requests of a pool.
+type QueueStatus struct {
+	Pool string `json:"pool"`
+	// the requests waiting for a backend.
+	Length    int `json:"length"`
+	MaxLength int `json:"max_length"`
+	// the requests that got a 503 because the queue was full, or because
+	// they waited until the timeout.
+	Overflows uint64 `json:"overflows"`
+	Timeouts  uint64 `json:"timeouts"`
+}
+
+func (h *handler) queues(w http.ResponseWriter, req *http.Request) {
+	manager, ok := h.manager.(QueueManager)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("the balancer does not queue requests"))
+		return
+	}
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, manager.Queues())
+}
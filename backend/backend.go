@@ -1,90 +1,494 @@
 package backend
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alidn/Yalp/tracing"
 	"github.com/google/uuid"
 )
 
+// Backend is a server the balancers send requests to. It is used by every
+// Balancer and by the Pool, and must be safe for concurrent use.
 type Backend interface {
+	ID() uuid.UUID
+	// URL returns a copy of the address of the backend.
+	URL() *url.URL
+	// Weight is the relative share of the traffic the backend should receive.
+	Weight() int
+	// Zone is the availability zone of the backend, it may be empty.
+	Zone() string
+	// Tags are arbitrary metadata set by the operator.
+	Tags() map[string]string
+
+	// IsAlive returns whether or not the backend passed its last
+	// health-check.
+	IsAlive() bool
 	CheckAlive() (bool, error)
+	State() AdminState
+	SetState(state AdminState)
+	// Watch calls f every time the backend may have become available: when
+	// it passes a health-check after failing one, and when its admin state
+	// changes. Only the last f is called.
+	Watch(f func())
+
+	// InFlight returns the number of requests currently proxied to the
+	// backend.
+	InFlight() int
+	// AddInFlight adds delta, which may be negative, to the number of
+	// requests in flight.
+	AddInFlight(delta int)
+	// MaxConnections returns the most requests the backend can have in
+	// flight, 0 if there is no limit.
+	MaxConnections() int
+	// TryAddInFlight adds a request in flight unless the backend already
+	// has MaxConnections of them, and reports whether it did.
+	TryAddInFlight() bool
+	// Latency returns the moving average of the response times of the
+	// backend.
+	Latency() time.Duration
+	// RecordRequest counts a request proxied to the backend. A request failed
+	// if the backend could not be reached or responded with a 5xx status.
+	RecordRequest(failed bool, latency time.Duration)
+	// Circuit returns the state of the circuit breaker of the backend, which
+	// is always closed if it is disabled.
+	Circuit() CircuitState
+	// AddSession records a new persistent session pinned to the backend that
+	// expires at the given time.
+	AddSession(expires time.Time)
+	// ExtendSession moves a session recorded by AddSession from the
+	// expiration time from to the one to.
+	ExtendSession(from time.Time, to time.Time)
+	// RemoveSession ends a session recorded by AddSession that expires at
+	// the given time before it expired.
+	RemoveSession(expires time.Time)
+	// Sessions returns the number of unexpired persistent sessions pinned to
+	// the backend.
+	Sessions() int
+
+	// Status returns a snapshot of the state of the backend.
+	Status() Status
+	// Close stops the health-check and waits for it to return.
+	Close()
+}
+
+// Options describes a backend.
+type Options struct {
+	URL string `yaml:"url" json:"url"`
+	// the relative share of the traffic, 1 if it is not set.
+	Weight int               `yaml:"weight" json:"weight,omitempty"`
+	Zone   string            `yaml:"zone" json:"zone,omitempty"`
+	Tags   map[string]string `yaml:"tags" json:"tags,omitempty"`
+	// how the backend is health-checked, the defaults are used for the
+	// fields that are not set.
+	HealthCheck HealthCheckConfig `yaml:"health_check" json:"health_check,omitempty"`
+	// the most requests in flight, there is no limit if it is not set.
+	MaxConnections int `yaml:"max_connections" json:"max_connections,omitempty"`
+	// the circuit breaker of the backend, disabled if it is not set.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker" json:"circuit_breaker,omitempty"`
+	// the id of the backend, a random one if it is not set.
+	ID uuid.UUID `yaml:"-" json:"-"`
+}
+
+// HealthCheckConfig configures the health-checks of a backend.
+type HealthCheckConfig struct {
+	// the path requested by the health-checks, the one of the URL of the
+	// backend if it is empty.
+	Path string `yaml:"path" json:"path,omitempty"`
+	// the time between two health-checks in seconds, 10 if it is not set.
+	Interval int `yaml:"interval" json:"interval,omitempty"`
+	// the timeout of a health-check request in seconds, 2 if it is not set.
+	Timeout int `yaml:"timeout" json:"timeout,omitempty"`
+}
+
+// AdminState is the state of a backend set by an operator, independently of
+// its health.
+type AdminState int32
+
+const (
+	// StateActive backends receive new and existing sessions.
+	StateActive AdminState = iota
+	// StateDraining backends only receive requests of existing sessions.
+	StateDraining
+	// StateMaintenance backends receive no requests at all.
+	StateMaintenance
+)
+
+func (s AdminState) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StateDraining:
+		return "draining"
+	case StateMaintenance:
+		return "maintenance"
+	}
+	return fmt.Sprintf("AdminState(%d)", int32(s))
 }
 
-// RoundRobinBackend represents a backend server.
-type RoundRobinBackend struct {
-	Id   uuid.UUID
-	Addr string
-	URL  url.URL
-	// shows whether or not the server is alive.
-	IsAlive           bool
-	healthCheckTicker *time.Ticker
-	sync.RWMutex
+// ParseAdminState returns the AdminState with the given name.
+func ParseAdminState(name string) (AdminState, error) {
+	for _, s := range []AdminState{StateActive, StateDraining, StateMaintenance} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return StateActive, errors.New(fmt.Sprintf("unknown backend state: %s", name))
+}
+
+// HTTPBackend is a Backend whose health is checked with HTTP requests.
+type HTTPBackend struct {
+	id     uuid.UUID
+	url    url.URL
+	weight int
+	zone   string
+	tags   map[string]string
+	// 0 if there is no limit.
+	maxConnections int
+	// the URL requested by the health-checks.
+	healthCheckURL      string
+	healthCheckInterval time.Duration
+	// the fields below are shared by the health-check goroutines and the
+	// requests, they are only accessed atomically or under a lock.
+	alive         int32
+	adminState    int32
+	inFlight      int32
+	sessions      sessionTable
+	healthHistory healthHistory
+	stats         trafficStats
+	latency       latencyStats
+	breaker       *circuitBreaker
+	// the func() set by Watch.
+	watcher atomic.Value
+	// serializes the health-checks.
+	checkMu sync.Mutex
+	// the health-checks stop when ctx is done.
+	ctx               context.Context
+	cancel            context.CancelFunc
+	healthCheckClient *http.Client
+	healthCheckDone   chan struct{}
 }
 
-func NewBackend(addr string) (*RoundRobinBackend, error) {
-	parsedURL, err := url.Parse(addr)
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// Status is a snapshot of the state of a backend.
+type Status struct {
+	ID              uuid.UUID         `json:"id"`
+	URL             string            `json:"url"`
+	Pool            string            `json:"pool,omitempty"` // set by the managers of several pools
+	Alive           bool              `json:"alive"`
+	State           string            `json:"state"`
+	Circuit         string            `json:"circuit"`
+	Weight          int               `json:"weight"`
+	Zone            string            `json:"zone,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	OpenConnections int               `json:"open_connections"`
+	MaxConnections  int               `json:"max_connections,omitempty"`
+	Sessions        int               `json:"sessions"`
+	Requests        uint64            `json:"requests"`
+	Errors          uint64            `json:"errors"`
+	// the moving average of the response times, in milliseconds.
+	Latency float64 `json:"latency"`
+	// the requests per second over the last minute.
+	RequestRate float64 `json:"request_rate"`
+	// the fraction of the requests that failed over the last minute.
+	ErrorRate     float64       `json:"error_rate"`
+	HealthHistory []HealthCheck `json:"health_history"`
+}
+
+// NewBackend constructs a backend for the given address and starts its
+// health-check, which runs until ctx is done or Close is called.
+func NewBackend(ctx context.Context, addr string) (*HTTPBackend, error) {
+	return NewBackendWithOptions(ctx, Options{URL: addr})
+}
+
+// NewBackendWithOptions is like NewBackend, but it also sets the weight, the
+// zone and the tags of the backend.
+func NewBackendWithOptions(ctx context.Context, options Options) (*HTTPBackend, error) {
+	parsedURL, err := url.Parse(options.URL)
 	if err != nil {
 		return nil, err
 	}
+	if options.Weight < 0 {
+		return nil, errors.New(fmt.Sprintf("the weight of %s cannot be negative", options.URL))
+	}
+	if options.MaxConnections < 0 {
+		return nil, errors.New(fmt.Sprintf("the max connections of %s cannot be negative", options.URL))
+	}
+	weight := options.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	tags := make(map[string]string, len(options.Tags))
+	for key, value := range options.Tags {
+		tags[key] = value
+	}
+	healthCheckURL := *parsedURL
+	if options.HealthCheck.Path != "" {
+		healthCheckURL.Path = options.HealthCheck.Path
+	}
+	healthCheckInterval := defaultHealthCheckInterval
+	if options.HealthCheck.Interval > 0 {
+		healthCheckInterval = time.Duration(options.HealthCheck.Interval) * time.Second
+	}
+	healthCheckTimeout := defaultHealthCheckTimeout
+	if options.HealthCheck.Timeout > 0 {
+		healthCheckTimeout = time.Duration(options.HealthCheck.Timeout) * time.Second
+	}
 
-	backend := &RoundRobinBackend{
-		Id:      uuid.New(),
-		Addr:    addr,
-		IsAlive: true,
-		URL:     *parsedURL,
+	id := options.ID
+	if id == uuid.Nil {
+		id = uuid.New()
 	}
-	go func() {
-		isAlive, err := backend.CheckAlive()
-		if err != nil {
-			backend.IsAlive = false
-		} else {
-			backend.IsAlive = isAlive
-		}
-	}()
 
+	ctx, cancel := context.WithCancel(ctx)
+	backend := &HTTPBackend{
+		id:                  id,
+		url:                 *parsedURL,
+		weight:              weight,
+		maxConnections:      options.MaxConnections,
+		zone:                options.Zone,
+		tags:                tags,
+		healthCheckURL:      healthCheckURL.String(),
+		healthCheckInterval: healthCheckInterval,
+		alive:               1,
+		breaker:             newCircuitBreaker(options.CircuitBreaker),
+		ctx:                 ctx,
+		cancel:              cancel,
+		healthCheckClient: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			Timeout:   healthCheckTimeout,
+		},
+		healthCheckDone: make(chan struct{}),
+	}
 	go func() {
-		err2 := backend.StartHealthCheck()
-		err = err2
+		defer close(backend.healthCheckDone)
+		defer backend.healthCheckClient.CloseIdleConnections()
+		if err := backend.StartHealthCheck(); err != nil {
+			log.Print("the health-check of ", backend.url.String(), " stopped: ", err)
+		}
 	}()
-	if err != nil {
-		return nil, err
-	}
 	return backend, nil
 }
 
-// StartHealthCheck starts the health-check which checks if the backend
-// is alive every second.
-func (b *RoundRobinBackend) StartHealthCheck() error {
-	// TODO: decide a better duration or use a config file
-	b.healthCheckTicker = time.NewTicker(time.Second * 10)
+// StartHealthCheck checks if the backend is alive right away and then every
+// health-check interval, until the backend is closed.
+func (b *HTTPBackend) StartHealthCheck() error {
+	ticker := time.NewTicker(b.healthCheckInterval)
+	defer ticker.Stop()
+
 	for {
+		isAlive, err := b.CheckAlive()
+		if b.ctx.Err() != nil {
+			// the backend was closed during the check, the result is meaningless.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b.setAlive(isAlive)
+
 		select {
-		case _ = <-b.healthCheckTicker.C:
-			isAlive, err := b.CheckAlive()
-			if err != nil {
-				return err
-			}
-			b.IsAlive = isAlive
+		case <-ticker.C:
+		case <-b.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Close stops the health-check and waits for it to return. Requests that are
+// being proxied to the backend are not interrupted. Calling Close more than
+// once has no effect.
+func (b *HTTPBackend) Close() {
+	b.cancel()
+	<-b.healthCheckDone
+}
+
+func (b *HTTPBackend) ID() uuid.UUID {
+	return b.id
+}
+
+// URL returns a copy of the address of the backend.
+func (b *HTTPBackend) URL() *url.URL {
+	u := b.url
+	return &u
+}
+
+func (b *HTTPBackend) Weight() int {
+	return b.weight
+}
+
+func (b *HTTPBackend) Zone() string {
+	return b.zone
+}
+
+// Tags returns a copy of the tags of the backend.
+func (b *HTTPBackend) Tags() map[string]string {
+	tags := make(map[string]string, len(b.tags))
+	for key, value := range b.tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+// IsAlive returns whether or not the server passed its last health-check.
+func (b *HTTPBackend) IsAlive() bool {
+	return atomic.LoadInt32(&b.alive) == 1
+}
+
+// setAlive records the result of a health-check.
+func (b *HTTPBackend) setAlive(alive bool) {
+	value := int32(0)
+	if alive {
+		value = 1
+	}
+	if atomic.SwapInt32(&b.alive, value) == 0 && alive {
+		b.notify()
+	}
+	b.healthHistory.add(HealthCheck{Time: time.Now(), Alive: alive})
+}
+
+// RecordRequest counts a request proxied to the backend. A request failed if
+// the backend could not be reached or responded with a 5xx status.
+func (b *HTTPBackend) RecordRequest(failed bool, latency time.Duration) {
+	b.stats.record(failed, time.Now())
+	b.latency.record(latency)
+	b.breaker.record(failed, time.Now())
+}
+
+// Circuit returns the state of the circuit breaker of the backend, which is
+// always closed if it is disabled.
+func (b *HTTPBackend) Circuit() CircuitState {
+	return b.breaker.get(time.Now())
+}
+
+// Latency returns the moving average of the response times of the backend.
+func (b *HTTPBackend) Latency() time.Duration {
+	return b.latency.average()
+}
+
+// State returns the admin state of the backend.
+func (b *HTTPBackend) State() AdminState {
+	return AdminState(atomic.LoadInt32(&b.adminState))
+}
+
+// SetState changes the admin state of the backend.
+func (b *HTTPBackend) SetState(state AdminState) {
+	atomic.StoreInt32(&b.adminState, int32(state))
+	b.notify()
+}
+
+func (b *HTTPBackend) Watch(f func()) {
+	b.watcher.Store(f)
+}
+
+// notify calls the function set by Watch.
+func (b *HTTPBackend) notify() {
+	if f, ok := b.watcher.Load().(func()); ok {
+		f()
+	}
+}
+
+// InFlight returns the number of requests currently proxied to the backend.
+func (b *HTTPBackend) InFlight() int {
+	return int(atomic.LoadInt32(&b.inFlight))
+}
+
+func (b *HTTPBackend) MaxConnections() int {
+	return b.maxConnections
+}
+
+// TryAddInFlight adds a request in flight unless the backend already has
+// MaxConnections of them, and reports whether it did.
+func (b *HTTPBackend) TryAddInFlight() bool {
+	for {
+		inFlight := atomic.LoadInt32(&b.inFlight)
+		if b.maxConnections > 0 && int(inFlight) >= b.maxConnections {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&b.inFlight, inFlight, inFlight+1) {
+			return true
 		}
 	}
 }
 
-// StopHealthCheck stops the health-check ticker.
-func (b *RoundRobinBackend) StopHealthCheck() {
-	b.healthCheckTicker.Stop()
+// AddInFlight adds delta, which may be negative, to the number of requests in
+// flight.
+func (b *HTTPBackend) AddInFlight(delta int) {
+	atomic.AddInt32(&b.inFlight, int32(delta))
+}
+
+// AddSession records a new persistent session pinned to the backend that
+// expires at the given time.
+func (b *HTTPBackend) AddSession(expires time.Time) {
+	b.sessions.add(expires)
 }
 
-// CheckAlive checks if the backend is still alive using a TCP connection
-// with a timeout of 2 seconds. It returns an error if the TCP connection
-// fails.
-func (b *RoundRobinBackend) CheckAlive() (bool, error) {
-	// println("Checking health", b.Addr)
-	b.Lock()
-	defer b.Unlock()
-	// _tcpURL := b.URL.Host
+// ExtendSession moves a session recorded by AddSession from the expiration
+// time from to the one to.
+func (b *HTTPBackend) ExtendSession(from time.Time, to time.Time) {
+	b.sessions.extend(from, to)
+}
+
+// RemoveSession ends a session recorded by AddSession that expires at the
+// given time before it expired.
+func (b *HTTPBackend) RemoveSession(expires time.Time) {
+	b.sessions.remove(expires)
+}
+
+// Sessions returns the number of unexpired persistent sessions pinned to the
+// backend.
+func (b *HTTPBackend) Sessions() int {
+	return b.sessions.count()
+}
+
+// Status returns a snapshot of the state of the backend.
+func (b *HTTPBackend) Status() Status {
+	requests, errors, requestRate, errorRate := b.stats.snapshot(time.Now())
+	return Status{
+		ID:              b.id,
+		URL:             b.url.String(),
+		Alive:           b.IsAlive(),
+		State:           b.State().String(),
+		Circuit:         b.Circuit().String(),
+		Weight:          b.weight,
+		Zone:            b.zone,
+		Tags:            b.Tags(),
+		OpenConnections: b.InFlight(),
+		MaxConnections:  b.maxConnections,
+		Sessions:        b.Sessions(),
+		Requests:        requests,
+		Errors:          errors,
+		Latency:         float64(b.Latency()) / float64(time.Millisecond),
+		RequestRate:     requestRate,
+		ErrorRate:       errorRate,
+		HealthHistory:   b.healthHistory.list(),
+	}
+}
+
+// CheckAlive checks if the backend is still alive using HTTP requests with
+// the health-check timeout, 2 seconds by default. It returns an error if the
+// backend is closed during the check.
+func (b *HTTPBackend) CheckAlive() (bool, error) {
+	b.checkMu.Lock()
+	defer b.checkMu.Unlock()
+
+	ctx, span := tracing.Start(b.ctx, "yalp.health_check", tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("yalp.backend.id", b.id.String())
+	span.SetAttribute("yalp.backend.url", b.url.String())
 
 	// The number of consecutive failed health checks that must occur before
 	// declaring the server unhealthy. This number is based on AWS Elastic Load Balancing
@@ -97,9 +501,21 @@ func (b *RoundRobinBackend) CheckAlive() (bool, error) {
 
 	consecutiveSuccessfulHealthChecks := 0
 	consecutiveFailedHealthChecks := 0
-	var closeError error
 	for consecutiveFailedHealthChecks < unhealthyThreshold && consecutiveSuccessfulHealthChecks < healthyThreshold {
-		_, err := http.Get(b.Addr)
+		if b.ctx.Err() != nil {
+			return false, b.ctx.Err()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.healthCheckURL, nil)
+		if err == nil {
+			tracing.Inject(req.Header, span.SpanContext())
+			var resp *http.Response
+			resp, err = b.healthCheckClient.Do(req)
+			if err == nil {
+				// the body must be read and closed for the connection to be reused.
+				_, _ = io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}
 		if err != nil {
 			consecutiveFailedHealthChecks++
 			consecutiveSuccessfulHealthChecks = 0
@@ -111,7 +527,10 @@ func (b *RoundRobinBackend) CheckAlive() (bool, error) {
 	}
 
 	if consecutiveFailedHealthChecks >= unhealthyThreshold {
-		return false, closeError
+		span.SetAttribute("yalp.backend.alive", false)
+		span.SetStatus(tracing.StatusError, "backend is unhealthy")
+		return false, nil
 	}
-	return true, closeError
+	span.SetAttribute("yalp.backend.alive", true)
+	return true, nil
 }
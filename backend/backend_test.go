@@ -0,0 +1,223 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+func newTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+// waitForHealthCheck waits until the backend recorded its first health-check.
+func waitForHealthCheck(t *testing.T, b Backend) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.Status().HealthHistory) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the backend was never health-checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolCloseStopsHealthChecks(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	server1, server2 := newTestServer(), newTestServer()
+	defer server1.Close()
+	defer server2.Close()
+
+	pool, err := NewBackendPoolFromURLs(context.Background(), server1.URL, server2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range pool.List() {
+		waitForHealthCheck(t, b)
+	}
+	pool.Close()
+	// closing twice must not block or panic.
+	pool.Close()
+}
+
+func TestContextCancellationStopsHealthCheck(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	server := newTestServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b, err := NewBackend(ctx, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealthCheck(t, b)
+	cancel()
+
+	select {
+	case <-b.healthCheckDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the health-check to stop when the context is canceled")
+	}
+	if !b.IsAlive() {
+		t.Errorf("expected the backend to keep its last health instead of being marked dead")
+	}
+}
+
+func TestCloseInterruptsHealthCheck(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+
+	b, err := NewBackend(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first health-check is stuck on the server, Close must not wait for
+	// its timeout.
+	start := time.Now()
+	b.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close to interrupt the health-check, it took %s", elapsed)
+	}
+}
+
+func TestNewBackendWithOptions(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+
+	tags := map[string]string{"version": "2"}
+	b, err := NewBackendWithOptions(context.Background(), Options{URL: server.URL, Zone: "eu-west-1a", Tags: tags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	tags["version"] = "3"
+	if b.Weight() != 1 || b.Zone() != "eu-west-1a" || b.Tags()["version"] != "2" {
+		t.Errorf("unexpected backend: weight %d, zone %q, tags %v", b.Weight(), b.Zone(), b.Tags())
+	}
+
+	b.RecordRequest(false, 100*time.Millisecond)
+	b.RecordRequest(false, 200*time.Millisecond)
+	if b.Latency() != 120*time.Millisecond {
+		t.Errorf("expected a moving average of 120ms, got %s", b.Latency())
+	}
+
+	if _, err := NewBackendWithOptions(context.Background(), Options{URL: server.URL, Weight: -1}); err == nil {
+		t.Error("expected a negative weight to be rejected")
+	}
+}
+
+func TestHealthCheckPath(t *testing.T) {
+	paths := make(chan string, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer server.Close()
+
+	b, err := NewBackendWithOptions(context.Background(), Options{URL: server.URL, HealthCheck: HealthCheckConfig{Path: "/healthz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	waitForHealthCheck(t, b)
+	if path := <-paths; path != "/healthz" {
+		t.Errorf("expected the health-check to request /healthz, got %s", path)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	b, err := NewBackendWithOptions(context.Background(), Options{URL: "http://127.0.0.1:1", MaxConnections: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if !b.TryAddInFlight() || !b.TryAddInFlight() {
+		t.Fatal("expected the backend to accept two requests")
+	}
+	if b.TryAddInFlight() || b.InFlight() != 2 {
+		t.Errorf("expected the backend to refuse a third request, got %d in flight", b.InFlight())
+	}
+	b.AddInFlight(-1)
+	if !b.TryAddInFlight() {
+		t.Error("expected the backend to accept a request once one finished")
+	}
+	if _, err := NewBackendWithOptions(context.Background(), Options{URL: "http://127.0.0.1:1", MaxConnections: -1}); err == nil {
+		t.Error("expected an error for negative max connections")
+	}
+}
+
+func TestSessionTableIsBounded(t *testing.T) {
+	var sessions sessionTable
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 10000; i++ {
+		sessions.add(expires.Add(time.Duration(i%3) * time.Second))
+	}
+	sessions.add(time.Now().Add(-time.Second))
+	if count := sessions.count(); count != 10000 {
+		t.Errorf("expected 10000 sessions, got %d", count)
+	}
+	if len(sessions.buckets) != 3 {
+		t.Errorf("expected the sessions to be counted in 3 buckets, got %d", len(sessions.buckets))
+	}
+}
+
+func TestExtendSession(t *testing.T) {
+	var sessions sessionTable
+	expires := time.Now().Add(time.Minute)
+	sessions.add(expires)
+	sessions.extend(expires, expires.Add(time.Hour))
+	if count := sessions.count(); count != 1 || len(sessions.buckets) != 1 || sessions.buckets[0].second != expirySecond(expires.Add(time.Hour)) {
+		t.Errorf("expected the session to move to its new expiration time, got %d sessions in %+v", count, sessions.buckets)
+	}
+	sessions.extend(expires, expires.Add(2*time.Hour))
+	if count := sessions.count(); count != 1 {
+		t.Errorf("expected an unknown session not to be counted, got %d sessions", count)
+	}
+	sessions.remove(expires.Add(time.Hour))
+	if count := sessions.count(); count != 0 || len(sessions.buckets) != 0 {
+		t.Errorf("expected the removed session not to be counted, got %d sessions in %+v", count, sessions.buckets)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(CircuitBreakerConfig{Failures: 2, OpenTimeout: 10})
+	now := time.Now()
+	breaker.record(true, now)
+	breaker.record(false, now)
+	breaker.record(true, now)
+	if state := breaker.get(now); state != CircuitClosed {
+		t.Errorf("expected a success to reset the failures, got %s", state)
+	}
+	breaker.record(true, now)
+	if state := breaker.get(now.Add(9 * time.Second)); state != CircuitOpen {
+		t.Errorf("expected 2 consecutive failures to open the circuit, got %s", state)
+	}
+	if state := breaker.get(now.Add(10 * time.Second)); state != CircuitHalfOpen {
+		t.Errorf("expected the circuit to be half-open after the timeout, got %s", state)
+	}
+	breaker.record(true, now.Add(10*time.Second))
+	if state := breaker.get(now.Add(11 * time.Second)); state != CircuitOpen {
+		t.Errorf("expected a failure to open the half-open circuit again, got %s", state)
+	}
+	breaker.get(now.Add(20 * time.Second))
+	breaker.record(false, now.Add(20*time.Second))
+	if state := breaker.get(now.Add(20 * time.Second)); state != CircuitClosed {
+		t.Errorf("expected a success to close the half-open circuit, got %s", state)
+	}
+
+	disabled := newCircuitBreaker(CircuitBreakerConfig{})
+	for i := 0; i < 10; i++ {
+		disabled.record(true, now)
+	}
+	if state := disabled.get(now); state != CircuitClosed {
+		t.Errorf("expected a disabled circuit breaker to stay closed, got %s", state)
+	}
+}
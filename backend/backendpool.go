@@ -1,42 +1,98 @@
 package backend
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+
 	"github.com/google/uuid"
 )
 
+// Pool is a group of backends that can be changed while it is being used.
 type Pool struct {
-	Backends []*RoundRobinBackend
+	Backends []Backend
+	sync.RWMutex
 }
 
 func NewBackendPool() *Pool {
 	return &Pool{
-		Backends: make([]*RoundRobinBackend, 0),
+		Backends: make([]Backend, 0),
 	}
 }
 
-func (p *Pool) Get(id uuid.UUID) (*RoundRobinBackend, error) {
+func (p *Pool) Get(id uuid.UUID) (Backend, error) {
+	p.RLock()
+	defer p.RUnlock()
 	for _, backend := range p.Backends {
-		if backend.Id == id {
+		if backend.ID() == id {
 			return backend, nil
 		}
 	}
 	return nil, errors.New(fmt.Sprintf("did not find a backend with the given id: %s", id))
 }
 
-// NewBackendPoolFromURLs constructs and returns a new BackendPool using the
-// given urls.
-func NewBackendPoolFromURLs(urls ...string) (*Pool, error) {
-	backendPool := &Pool{
-		Backends: make([]*RoundRobinBackend, 0),
+// List returns a copy of the backends in the pool.
+func (p *Pool) List() []Backend {
+	p.RLock()
+	defer p.RUnlock()
+	backends := make([]Backend, len(p.Backends))
+	copy(backends, p.Backends)
+	return backends
+}
+
+// Add adds the backend to the end of the pool.
+func (p *Pool) Add(backend Backend) {
+	p.Lock()
+	defer p.Unlock()
+	p.Backends = append(p.Backends, backend)
+}
+
+// Remove removes the backend with the given id from the pool and returns it.
+func (p *Pool) Remove(id uuid.UUID) (Backend, error) {
+	p.Lock()
+	defer p.Unlock()
+	for i, backend := range p.Backends {
+		if backend.ID() == id {
+			backends := make([]Backend, 0, len(p.Backends)-1)
+			backends = append(backends, p.Backends[:i]...)
+			p.Backends = append(backends, p.Backends[i+1:]...)
+			return backend, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("did not find a backend with the given id: %s", id))
+}
+
+// Close closes every backend in the pool and waits for their health-checks
+// to return.
+func (p *Pool) Close() {
+	for _, backend := range p.List() {
+		backend.Close()
 	}
+}
+
+// NewBackendPoolFromURLs constructs and returns a new BackendPool using the
+// given urls. The health-checks of the backends run until ctx is done or the
+// pool is closed.
+func NewBackendPoolFromURLs(ctx context.Context, urls ...string) (*Pool, error) {
+	options := make([]Options, 0, len(urls))
 	for _, url := range urls {
-		backend, err := NewBackend(url)
+		options = append(options, Options{URL: url})
+	}
+	return NewBackendPoolFromOptions(ctx, options...)
+}
+
+// NewBackendPoolFromOptions is like NewBackendPoolFromURLs, but it also sets
+// the weight, the zone and the tags of the backends.
+func NewBackendPoolFromOptions(ctx context.Context, options ...Options) (*Pool, error) {
+	backendPool := NewBackendPool()
+	for _, o := range options {
+		backend, err := NewBackendWithOptions(ctx, o)
 		if err != nil {
+			backendPool.Close()
 			return nil, err
 		}
-		backendPool.Backends = append(backendPool.Backends, backend)
+		backendPool.Add(backend)
 	}
 
 	return backendPool, nil
@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultCircuitOpenTimeout = 30 * time.Second
+
+// CircuitBreakerConfig configures the circuit breaker of a backend, which
+// stops sending requests to a backend whose requests keep failing, even if it
+// passes its health-checks.
+type CircuitBreakerConfig struct {
+	// the consecutive failed requests that open the circuit, the circuit
+	// breaker is disabled if it is not set.
+	Failures int `yaml:"failures" json:"failures,omitempty"`
+	// the seconds the circuit stays open before requests are let through to
+	// try the backend again, 30 if it is not set.
+	OpenTimeout int `yaml:"open_timeout" json:"open_timeout,omitempty"`
+}
+
+// CircuitState is the state of the circuit breaker of a backend.
+type CircuitState int32
+
+const (
+	// CircuitClosed backends receive requests.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen backends receive no requests until the open timeout.
+	CircuitOpen
+	// CircuitHalfOpen backends receive requests again, the first result
+	// closes the circuit or opens it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int32(s))
+}
+
+// circuitBreaker counts the consecutive failed requests of a backend.
+type circuitBreaker struct {
+	failures    int
+	openTimeout time.Duration
+
+	mu          sync.Mutex
+	state       CircuitState
+	consecutive int
+	openedAt    time.Time
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	openTimeout := defaultCircuitOpenTimeout
+	if config.OpenTimeout > 0 {
+		openTimeout = time.Duration(config.OpenTimeout) * time.Second
+	}
+	return &circuitBreaker{failures: config.Failures, openTimeout: openTimeout}
+}
+
+// record counts the result of a request.
+func (c *circuitBreaker) record(failed bool, now time.Time) {
+	if c.failures <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		c.consecutive = 0
+		c.state = CircuitClosed
+		return
+	}
+	c.consecutive++
+	if c.state == CircuitHalfOpen || c.consecutive >= c.failures {
+		c.state = CircuitOpen
+		c.openedAt = now
+	}
+}
+
+// get returns the state of the circuit. An open circuit becomes half-open
+// once it has been open for the open timeout.
+func (c *circuitBreaker) get(now time.Time) CircuitState {
+	if c.failures <= 0 {
+		return CircuitClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= c.openTimeout {
+		c.state = CircuitHalfOpen
+	}
+	return c.state
+}
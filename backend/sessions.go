@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionBucket counts the sessions that expire during the same second.
+type sessionBucket struct {
+	second int64
+	count  int
+}
+
+// sessionTable counts the persistent sessions pinned to a backend in
+// one-second expiry buckets, oldest first, so that its size is bounded by the
+// session expiry in seconds rather than by the number of sessions.
+type sessionTable struct {
+	buckets []sessionBucket
+	total   int
+	sync.Mutex
+}
+
+func (t *sessionTable) add(expires time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t.prune(time.Now())
+	t.insert(expirySecond(expires))
+}
+
+// extend moves a session from the expiration time from to the one to. The
+// sessions that already expired are not counted again.
+func (t *sessionTable) extend(from time.Time, to time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t.prune(time.Now())
+	if t.delete(expirySecond(from)) {
+		t.insert(expirySecond(to))
+	}
+}
+
+// remove stops counting a session that expires at expires before it expired.
+func (t *sessionTable) remove(expires time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t.prune(time.Now())
+	t.delete(expirySecond(expires))
+}
+
+// delete uncounts a session that expires during the given second, and
+// reports whether there was one.
+func (t *sessionTable) delete(second int64) bool {
+	for i := len(t.buckets) - 1; i >= 0 && t.buckets[i].second >= second; i-- {
+		if t.buckets[i].second != second {
+			continue
+		}
+		t.total--
+		if t.buckets[i].count--; t.buckets[i].count == 0 {
+			t.buckets = append(t.buckets[:i], t.buckets[i+1:]...)
+		}
+		return true
+	}
+	return false
+}
+
+// insert counts a session that expires during the given second.
+func (t *sessionTable) insert(second int64) {
+	// sessions usually expire in the order they were created, so searching
+	// from the back finds the bucket in constant time.
+	i := len(t.buckets)
+	for i > 0 && t.buckets[i-1].second > second {
+		i--
+	}
+	t.total++
+	if i > 0 && t.buckets[i-1].second == second {
+		t.buckets[i-1].count++
+		return
+	}
+	t.buckets = append(t.buckets, sessionBucket{})
+	copy(t.buckets[i+1:], t.buckets[i:])
+	t.buckets[i] = sessionBucket{second: second, count: 1}
+}
+
+func (t *sessionTable) count() int {
+	t.Lock()
+	defer t.Unlock()
+	t.prune(time.Now())
+	return t.total
+}
+
+// prune removes the sessions that expired before now.
+func (t *sessionTable) prune(now time.Time) {
+	expired := 0
+	for expired < len(t.buckets) && t.buckets[expired].second <= now.Unix() {
+		t.total -= t.buckets[expired].count
+		expired++
+	}
+	t.buckets = t.buckets[expired:]
+}
+
+// expirySecond returns the first second by which a session that expires at
+// expires is gone. Rounding up keeps the session counted until it expired.
+func expirySecond(expires time.Time) int64 {
+	second := expires.Unix()
+	if expires.After(time.Unix(second, 0)) {
+		second++
+	}
+	return second
+}
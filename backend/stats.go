@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// the number of health-check results kept for each backend.
+	healthHistorySize = 30
+	// the rates are computed over the last statsWindow seconds.
+	statsWindow = 60
+)
+
+// HealthCheck is the result of one health-check.
+type HealthCheck struct {
+	Time  time.Time `json:"time"`
+	Alive bool      `json:"alive"`
+}
+
+// healthHistory keeps the most recent health-check results, oldest first.
+type healthHistory struct {
+	checks []HealthCheck
+	sync.Mutex
+}
+
+func (h *healthHistory) add(check HealthCheck) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.checks) == healthHistorySize {
+		copy(h.checks, h.checks[1:])
+		h.checks = h.checks[:len(h.checks)-1]
+	}
+	h.checks = append(h.checks, check)
+}
+
+func (h *healthHistory) list() []HealthCheck {
+	h.Lock()
+	defer h.Unlock()
+	checks := make([]HealthCheck, len(h.checks))
+	copy(checks, h.checks)
+	return checks
+}
+
+type statsBucket struct {
+	second   int64
+	requests uint64
+	errors   uint64
+}
+
+// trafficStats counts the requests proxied to a backend and the ones that
+// failed, in total and in one-second buckets for the last statsWindow seconds.
+type trafficStats struct {
+	requests uint64
+	errors   uint64
+	buckets  [statsWindow]statsBucket
+	sync.Mutex
+}
+
+func (s *trafficStats) record(failed bool, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	second := now.Unix()
+	bucket := &s.buckets[second%statsWindow]
+	if bucket.second != second {
+		*bucket = statsBucket{second: second}
+	}
+	bucket.requests++
+	s.requests++
+	if failed {
+		bucket.errors++
+		s.errors++
+	}
+}
+
+// snapshot returns the totals, the requests per second and the fraction of
+// failed requests over the last statsWindow seconds.
+func (s *trafficStats) snapshot(now time.Time) (uint64, uint64, float64, float64) {
+	s.Lock()
+	defer s.Unlock()
+	var requests, errors uint64
+	for _, bucket := range s.buckets {
+		if now.Unix()-bucket.second < statsWindow {
+			requests += bucket.requests
+			errors += bucket.errors
+		}
+	}
+	errorRate := 0.0
+	if requests > 0 {
+		errorRate = float64(errors) / float64(requests)
+	}
+	return s.requests, s.errors, float64(requests) / statsWindow, errorRate
+}
+
+// the weight of the newest response time in the latency moving average.
+const latencySmoothing = 0.2
+
+// latencyStats is an exponentially weighted moving average of the response
+// times of a backend.
+type latencyStats struct {
+	// in nanoseconds.
+	ewma     float64
+	recorded bool
+	sync.Mutex
+}
+
+func (l *latencyStats) record(latency time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if !l.recorded {
+		l.ewma = float64(latency)
+		l.recorded = true
+		return
+	}
+	l.ewma += latencySmoothing * (float64(latency) - l.ewma)
+}
+
+func (l *latencyStats) average() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	return time.Duration(l.ewma)
+}
@@ -0,0 +1,268 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The ways the session persistence finds the session of a request, see
+// SessionPersistenceConfig.Affinity.
+const (
+	AffinityCookie   = "cookie"
+	AffinitySourceIP = "source_ip"
+	AffinityHeader   = "header"
+	// the sessions of a cookie set by the backends, such as JSESSIONID.
+	AffinityAppCookie = "app_cookie"
+)
+
+// the most sessions an affinity table holds by default, the least recently
+// used ones are forgotten first.
+const defaultMaxSessions = 100000
+
+// affinityKey returns the function that returns the key of the session of a
+// request for the affinities that are not based on a cookie, or nil for the
+// cookie one. The requests whose key is empty have no session.
+func affinityKey(config SessionPersistenceConfig, clientIP func(req *http.Request) net.IP) (func(req *http.Request) string, error) {
+	switch config.Affinity {
+	case "", AffinityCookie:
+		return nil, nil
+	case AffinitySourceIP:
+		return newSourceIPKey(config.SourceIP, clientIP)
+	case AffinityAppCookie:
+		if config.Cookie == "" {
+			return nil, errors.New("the app_cookie affinity requires a cookie")
+		}
+		return func(req *http.Request) string {
+			cookie, err := req.Cookie(config.Cookie)
+			if err != nil {
+				return ""
+			}
+			return cookie.Value
+		}, nil
+	case AffinityHeader:
+		if config.Header == "" {
+			return nil, errors.New("the header affinity requires a header")
+		}
+		name := http.CanonicalHeaderKey(config.Header)
+		return func(req *http.Request) string {
+			return req.Header.Get(name)
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown session persistence affinity: %s", config.Affinity))
+}
+
+// newSourceIPKey returns the function that returns the address of the
+// client, or the prefix of the given length of it.
+func newSourceIPKey(config SourceIPConfig, clientIP func(req *http.Request) net.IP) (func(req *http.Request) string, error) {
+	ipv4Prefix, ipv6Prefix := config.IPv4Prefix, config.IPv6Prefix
+	if ipv4Prefix == 0 {
+		ipv4Prefix = 32
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = 128
+	}
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, errors.New(fmt.Sprintf("invalid source IP prefixes: /%d and /%d", ipv4Prefix, ipv6Prefix))
+	}
+	return func(req *http.Request) string {
+		ip := clientIP(req)
+		if ip == nil {
+			return ""
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(ipv4Prefix, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(ipv6Prefix, 128)).String()
+	}, nil
+}
+
+// clientIPs returns the function that returns the address of the client of a
+// request, see TrustedProxies.
+func (c Config) clientIPs() (func(req *http.Request) net.IP, error) {
+	trusted, err := parseNetworks(c.TrustedProxies)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid trusted proxies: %s", err))
+	}
+	return func(req *http.Request) net.IP {
+		return clientIP(req, trusted)
+	}, nil
+}
+
+// parseNetworks parses a list of CIDRs, the addresses without a prefix are
+// networks of a single address.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// clientIP returns the address of the client of the request. If the request
+// comes from a trusted proxy, it is the last address of X-Forwarded-For that
+// is not a trusted proxy.
+func clientIP(req *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !contains(trusted, ip) {
+		return ip
+	}
+	var forwarded []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !contains(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionCounter counts the sessions of an affinity table on their backends.
+type sessionCounter interface {
+	// extendSession is called when a session is extended, with its previous
+	// and its new expiration time.
+	extendSession(id uuid.UUID, from time.Time, to time.Time)
+	// endSession is called when a session is forgotten, moved to another
+	// backend or evicted before it expired.
+	endSession(id uuid.UUID, expires time.Time)
+}
+
+// affinityTable maps the keys of the sessions to the ids of their backends,
+// until the sessions expire.
+type affinityTable struct {
+	mu         sync.Mutex
+	configured sync.Once
+	// the sessions that are used before they expire are extended by this
+	// time, if it is set.
+	idleTimeout time.Duration
+	// counter is called with the table locked. It can be nil.
+	counter sessionCounter
+	// the *affinityEntry of the sessions by key.
+	entries *lruCache
+}
+
+type affinityEntry struct {
+	id      uuid.UUID
+	expires time.Time
+}
+
+func newAffinityTable(maxEntries int, idleTimeout time.Duration) *affinityTable {
+	t := &affinityTable{idleTimeout: idleTimeout, entries: newLRUCache(maxEntries)}
+	t.entries.evicted = func(key string, value interface{}) {
+		t.end(value.(*affinityEntry))
+	}
+	return t
+}
+
+// configure sets the most entries of the table, the idle timeout of its
+// sessions and their counter, only the first call has an effect. The table
+// is shared by the proxies of the pool, which have the same config.
+func (t *affinityTable) configure(maxEntries int, idleTimeout time.Duration, counter sessionCounter) {
+	t.configured.Do(func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.entries.maxEntries = maxEntries
+		t.idleTimeout = idleTimeout
+		t.counter = counter
+	})
+}
+
+// remove forgets the session with the given key.
+func (t *affinityTable) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if value, ok := t.entries.get(key); ok {
+		t.entries.remove(key)
+		t.end(value.(*affinityEntry))
+	}
+}
+
+// get returns the backend id of the session with the given key, and whether
+// there is one that did not expire.
+func (t *affinityTable) get(key string) (uuid.UUID, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	value, ok := t.entries.get(key)
+	if !ok {
+		return uuid.UUID{}, false
+	}
+	entry := value.(*affinityEntry)
+	if !sessionClock().Before(entry.expires) {
+		t.entries.remove(key)
+		return uuid.UUID{}, false
+	}
+	if t.idleTimeout > 0 {
+		t.extend(entry, sessionClock().Add(t.idleTimeout))
+	}
+	return entry.id, true
+}
+
+// put records the session with the given key on the backend id until
+// expires, and reports whether it is a new session. The session with the
+// same key is extended if it is on the same backend, and ended otherwise.
+func (t *affinityTable) put(key string, id uuid.UUID, expires time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if value, ok := t.entries.get(key); ok {
+		entry := value.(*affinityEntry)
+		if entry.id == id && sessionClock().Before(entry.expires) {
+			t.extend(entry, expires)
+			return false
+		}
+		t.end(entry)
+	}
+	t.entries.add(key, &affinityEntry{id: id, expires: expires})
+	return true
+}
+
+func (t *affinityTable) extend(entry *affinityEntry, expires time.Time) {
+	from := entry.expires
+	entry.expires = expires
+	if t.counter != nil {
+		t.counter.extendSession(entry.id, from, expires)
+	}
+}
+
+// end reports the end of a session that did not expire yet.
+func (t *affinityTable) end(entry *affinityEntry) {
+	if t.counter != nil && sessionClock().Before(entry.expires) {
+		t.counter.endSession(entry.id, entry.expires)
+	}
+}
@@ -0,0 +1,330 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAffinityTable(t *testing.T) {
+	table := newAffinityTable(2, 0)
+	first, second, third := uuid.New(), uuid.New(), uuid.New()
+	expires := time.Now().Add(time.Minute)
+
+	table.put("a", first, expires)
+	table.put("b", second, expires)
+	if id, ok := table.get("a"); !ok || id != first {
+		t.Errorf("expected the session of a on %s, got %s %t", first, id, ok)
+	}
+	// b is the least recently used session now.
+	table.put("c", third, expires)
+	if _, ok := table.get("b"); ok {
+		t.Error("expected the least recently used session to be forgotten")
+	}
+	if id, ok := table.get("c"); !ok || id != third {
+		t.Errorf("expected the session of c on %s, got %s %t", third, id, ok)
+	}
+
+	table.put("a", second, time.Now().Add(-time.Second))
+	if _, ok := table.get("a"); ok {
+		t.Error("expected an expired session to be forgotten")
+	}
+	if table.entries.len() != 1 {
+		t.Errorf("expected the expired session to be removed, got %d entries", table.entries.len())
+	}
+}
+
+func TestAffinityWithEveryAlgorithm(t *testing.T) {
+	for _, algorithm := range []Algorithm{RoundRobin, LeastConnection} {
+		for _, affinity := range []string{AffinityCookie, AffinitySourceIP, AffinityHeader} {
+			servers, urls := newCountingServers(2)
+			router, err := NewRouter(context.Background(), Config{
+				Algorithm: algorithm,
+				URLs:      urls,
+				SessionPersistenceConfig: SessionPersistenceConfig{
+					Enabled:          true,
+					ExpirationPeriod: 60,
+					Affinity:         affinity,
+					Header:           "X-Api-Key",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy := httptest.NewServer(router)
+
+			for _, key := range []string{"first", "second"} {
+				jar, _ := cookiejar.New(nil)
+				client := &http.Client{Jar: jar}
+				before0, before1 := servers[0].count(), servers[1].count()
+				for i := 0; i < 10; i++ {
+					req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+					req.Header.Set("X-Test", "1")
+					req.Header.Set("X-Api-Key", key)
+					resp, err := client.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					resp.Body.Close()
+				}
+				served0, served1 := servers[0].count()-before0, servers[1].count()-before1
+				if served0 != 10 && served1 != 10 {
+					t.Errorf("%s with the %s affinity: expected every request of %s on the same backend, got %d and %d",
+						algorithm, affinity, key, served0, served1)
+				}
+			}
+
+			proxy.Close()
+			router.Close()
+			closeServers(servers)
+		}
+	}
+}
+
+func TestInvalidAffinity(t *testing.T) {
+	for _, sessions := range []SessionPersistenceConfig{
+		{Enabled: true, Affinity: "server"},
+		{Enabled: true, Affinity: AffinityHeader},
+		{Enabled: true, Affinity: AffinityAppCookie},
+	} {
+		router, err := NewRouter(context.Background(), Config{URLs: []string{"http://127.0.0.1:1"}, SessionPersistenceConfig: sessions})
+		if err == nil {
+			router.Close()
+			t.Errorf("expected an error for %+v", sessions)
+		}
+	}
+}
+
+// newSessionServer is a backend that starts a JSESSIONID session on the
+// requests without one.
+func newSessionServer() *countingServer {
+	s := &countingServer{}
+	s.Server = newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.served, 1)
+		if _, err := r.Cookie("JSESSIONID"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: uuid.New().String()})
+		}
+	})
+	return s
+}
+
+func TestAppCookieAffinity(t *testing.T) {
+	servers := []*countingServer{newSessionServer(), newSessionServer()}
+	defer closeServers(servers)
+	router, err := NewRouter(context.Background(), Config{
+		URLs: []string{servers[0].URL, servers[1].URL},
+		SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 60,
+			Affinity:         AffinityAppCookie,
+			Cookie:           "JSESSIONID",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	for i := 0; i < 4; i++ {
+		jar, _ := cookiejar.New(nil)
+		before0, before1 := servers[0].count(), servers[1].count()
+		makeTestRequests(10, &http.Client{Jar: jar}, proxy.URL)
+		served0, served1 := servers[0].count()-before0, servers[1].count()-before1
+		if served0 != 10 && served1 != 10 {
+			t.Errorf("expected every request of a session on the same backend, got %d and %d", served0, served1)
+		}
+		proxyURL, _ := url.Parse(proxy.URL)
+		for _, cookie := range jar.Cookies(proxyURL) {
+			if cookie.Name != "JSESSIONID" {
+				t.Errorf("expected Yalp not to set a cookie, got %s", cookie.Name)
+			}
+		}
+	}
+	sessions := 0
+	for _, status := range router.BackendStatuses() {
+		sessions += status.Sessions
+	}
+	if sessions != 4 {
+		t.Errorf("expected 4 sessions, got %d", sessions)
+	}
+}
+
+func TestRoutesShareAffinity(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+	router, proxy := newTestRouter(t, Config{
+		Pools: []PoolConfig{{Name: "app", URLs: urls, SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 60,
+			Affinity:         AffinitySourceIP,
+		}}},
+		Routes: []RouteConfig{
+			{Name: "a", PathPrefix: "/a", Pool: "app"},
+			{Name: "b", PathPrefix: "/b", Pool: "app"},
+		},
+	})
+
+	makeTestRequests(5, http.DefaultClient, proxy.URL+"/a")
+	makeTestRequests(5, http.DefaultClient, proxy.URL+"/b")
+	if servers[0].count() != 10 && servers[1].count() != 10 {
+		t.Errorf("expected the routes of the pool to share the session, got %d and %d", servers[0].count(), servers[1].count())
+	}
+	sessions := 0
+	for _, status := range router.BackendStatuses() {
+		sessions += status.Sessions
+	}
+	if sessions != 1 {
+		t.Errorf("expected 1 session, got %d", sessions)
+	}
+}
+
+func TestSourceIPKey(t *testing.T) {
+	clientIP, err := Config{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}.clientIPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newSourceIPKey(SourceIPConfig{IPv4Prefix: 24, IPv6Prefix: 64}, clientIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		key        string
+	}{
+		{"203.0.113.7:5000", "", "203.0.113.0"},
+		{"[2001:db8:1:2:3::4]:5000", "", "2001:db8:1:2::"},
+		// X-Forwarded-For is ignored if the request does not come from a
+		// trusted proxy.
+		{"203.0.113.7:5000", "198.51.100.1", "203.0.113.0"},
+		{"10.1.2.3:5000", "198.51.100.1", "198.51.100.0"},
+		{"192.168.1.1:5000", "192.0.2.1, 198.51.100.1, 10.0.0.2", "198.51.100.0"},
+		{"10.1.2.3:5000", "10.0.0.2", "10.0.0.0"},
+		{"10.1.2.3:5000", "", "10.1.2.0"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := key(req); got != test.key {
+			t.Errorf("%s forwarded for %q: expected %s, got %s", test.remoteAddr, test.forwarded, test.key, got)
+		}
+	}
+
+	for _, config := range []SourceIPConfig{{IPv4Prefix: 33}, {IPv6Prefix: -1}} {
+		if _, err := newSourceIPKey(config, clientIP); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+	if _, err := (Config{TrustedProxies: []string{"proxy"}}).clientIPs(); err == nil {
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestAffinityTableIdleTimeout(t *testing.T) {
+	table := newAffinityTable(10, 50*time.Millisecond)
+	id := uuid.New()
+	expires := time.Now().Add(50 * time.Millisecond)
+	table.counter = &testCounter{extend: func(extendedID uuid.UUID, from time.Time, to time.Time) {
+		if extendedID != id || !from.Equal(expires) || !to.After(from) {
+			t.Errorf("expected the session to be extended from %s, got %s from %s to %s", expires, extendedID, from, to)
+		}
+		expires = to
+	}}
+	table.put("a", id, expires)
+	for i := 0; i < 4; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if _, ok := table.get("a"); !ok {
+			t.Fatal("expected a session in use not to expire")
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := table.get("a"); ok {
+		t.Error("expected an idle session to expire")
+	}
+}
+
+// testCounter records the sessions an affinity table ends.
+type testCounter struct {
+	extend func(id uuid.UUID, from time.Time, to time.Time)
+	ended  []uuid.UUID
+}
+
+func (c *testCounter) extendSession(id uuid.UUID, from time.Time, to time.Time) {
+	if c.extend != nil {
+		c.extend(id, from, to)
+	}
+}
+
+func (c *testCounter) endSession(id uuid.UUID, expires time.Time) {
+	c.ended = append(c.ended, id)
+}
+
+func TestAffinityTableEndsSessions(t *testing.T) {
+	table := newAffinityTable(1, 0)
+	extended := 0
+	counter := &testCounter{extend: func(id uuid.UUID, from time.Time, to time.Time) {
+		extended++
+	}}
+	table.counter = counter
+	first, second, third := uuid.New(), uuid.New(), uuid.New()
+	expires := time.Now().Add(time.Minute)
+
+	if !table.put("a", first, expires) || table.put("a", first, expires.Add(time.Minute)) {
+		t.Error("expected only the first put of a session to start it")
+	}
+	if extended != 1 || len(counter.ended) != 0 {
+		t.Errorf("expected the refreshed session to be extended, got %d extended and %v ended", extended, counter.ended)
+	}
+	if !table.put("a", second, expires) {
+		t.Error("expected the session moved to another backend to start again")
+	}
+	table.remove("a")
+	table.put("b", third, expires)
+	table.put("c", third, expires)
+	if len(counter.ended) != 3 || counter.ended[0] != first || counter.ended[1] != second || counter.ended[2] != third {
+		t.Errorf("expected the moved, removed and evicted sessions to end, got %v", counter.ended)
+	}
+}
+
+func TestAppCookieSessionEnds(t *testing.T) {
+	server := newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logout" {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", MaxAge: -1})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "session"})
+	})
+	defer server.Close()
+	router, proxy := newTestRouter(t, Config{
+		URLs: []string{server.URL},
+		SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 60,
+			Affinity:         AffinityAppCookie,
+			Cookie:           "JSESSIONID",
+		},
+	})
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	makeTestRequests(5, client, proxy.URL)
+	if sessions := router.BackendStatuses()[0].Sessions; sessions != 1 {
+		t.Errorf("expected the refreshed cookie to keep 1 session, got %d", sessions)
+	}
+	makeTestRequests(1, client, proxy.URL+"/logout")
+	if sessions := router.BackendStatuses()[0].Sessions; sessions != 0 {
+		t.Errorf("expected the deleted cookie to end the session, got %d", sessions)
+	}
+}
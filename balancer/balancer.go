@@ -1,9 +1,42 @@
 package balancer
 
 import (
-	"net/http/httputil"
+	"net/http"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
 )
 
+// Balancer selects the backend of every request. The proxy engine returned
+// by NewProxy uses it to route the requests, but it can be used on its own.
 type Balancer interface {
-	NewReverseProxy() *httputil.ReverseProxy
+	// Pick returns the backend the request should be sent to and a function
+	// that must be called with the result of the request once it is over.
+	// It returns an error if no backend can serve the request.
+	Pick(req *http.Request) (backend.Backend, func(Result), error)
+	// Backend returns the backend with the given id, it is used to send the
+	// requests of a session to the backend that started it.
+	Backend(id uuid.UUID) (backend.Backend, error)
+	// NewReverseProxy returns the proxy engine of NewProxy for the balancer
+	// and its config.
+	NewReverseProxy() http.Handler
+	// Close stops the health-checks of every backend and waits for them to
+	// return.
+	Close()
+}
+
+// Result is the outcome of a request sent to a backend.
+type Result struct {
+	// the status code of the response, 0 if the backend could not be reached.
+	StatusCode int
+	Err        error
+	// the time between picking the backend and receiving the response
+	// headers.
+	Duration time.Duration
+}
+
+// Failed reports whether the backend failed to serve the request.
+func (r Result) Failed() bool {
+	return r.Err != nil || r.StatusCode >= http.StatusInternalServerError
 }
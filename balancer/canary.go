@@ -0,0 +1,220 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/alidn/Yalp/admin"
+	"github.com/alidn/Yalp/tracing"
+)
+
+// CanaryConfig sends a share of the requests of a route to another pool.
+type CanaryConfig struct {
+	Pool string `yaml:"pool"`
+	// the percentage of the requests sent to the canary pool, from 0 to 100.
+	// It can be changed at runtime with the admin API.
+	Percent float64 `yaml:"percent"`
+	// keeps the clients on the variant that served their first request. It
+	// enables the session persistence of both pools.
+	Sticky bool `yaml:"sticky"`
+	// send the requests that match them to a given variant, before the
+	// percentage and the stickiness are considered.
+	Overrides []CanaryOverride `yaml:"overrides"`
+}
+
+// CanaryOverride matches the requests that carry a header or a cookie, with
+// one of the given values if there are any.
+type CanaryOverride struct {
+	Header string   `yaml:"header"`
+	Cookie string   `yaml:"cookie"`
+	Values []string `yaml:"values"`
+	// the pool of the route or the canary pool.
+	Pool string `yaml:"pool"`
+}
+
+// value returns the value of the header or the cookie of the override, and
+// whether the request has it.
+func (o CanaryOverride) value(req *http.Request) (string, bool) {
+	if o.Header != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(o.Header)]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	}
+	cookie, err := req.Cookie(o.Cookie)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func (o CanaryOverride) matches(req *http.Request) bool {
+	value, ok := o.value(req)
+	if !ok {
+		return false
+	}
+	if len(o.Values) == 0 {
+		return true
+	}
+	for _, v := range o.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type override struct {
+	CanaryOverride
+	variant *variant
+}
+
+// split sends the requests of a route either to its pool or to its canary
+// pool.
+type split struct {
+	route string
+	// the bits of the percentage, it is changed by the admin API.
+	percent uint64
+	sticky  bool
+	// verifies the session cookies of a sticky split, whose names are
+	// cookies.
+	sessions *sessionSigner
+	cookies  []string
+	// the primary variant, then the canary one.
+	variants  [2]*variant
+	overrides []override
+}
+
+type variant struct {
+	name     string
+	pool     *pool
+	handler  http.Handler
+	requests uint64
+	errors   uint64
+	// the requests sent to the variant by an override.
+	overridden uint64
+}
+
+func newSplit(route string, canary CanaryConfig, sessions *sessionSigner, cookies []string, primary *variant, secondary *variant) (*split, error) {
+	s := &split{
+		route:    route,
+		sticky:   canary.Sticky,
+		sessions: sessions,
+		cookies:  cookies,
+		variants: [2]*variant{primary, secondary},
+	}
+	if err := s.setPercent(canary.Percent); err != nil {
+		return nil, err
+	}
+	for _, o := range canary.Overrides {
+		if (o.Header == "") == (o.Cookie == "") {
+			return nil, errors.New(fmt.Sprintf("a canary override of the route %s must have either a header or a cookie", route))
+		}
+		var target *variant
+		for _, v := range s.variants {
+			if v.pool.name == o.Pool {
+				target = v
+				break
+			}
+		}
+		if target == nil {
+			return nil, errors.New(fmt.Sprintf("a canary override of the route %s uses the pool %s, which is not one of its variants", route, o.Pool))
+		}
+		s.overrides = append(s.overrides, override{CanaryOverride: o, variant: target})
+	}
+	return s, nil
+}
+
+func (s *split) setPercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return errors.New(fmt.Sprintf("the canary percent of the route %s must be between 0 and 100", s.route))
+	}
+	atomic.StoreUint64(&s.percent, math.Float64bits(percent))
+	return nil
+}
+
+func (s *split) getPercent() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.percent))
+}
+
+func (s *split) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	v := s.choose(req)
+	writer := tracing.NewStatusRecorder(w)
+	v.handler.ServeHTTP(writer, req)
+	atomic.AddUint64(&v.requests, 1)
+	if writer.Status() >= http.StatusInternalServerError {
+		atomic.AddUint64(&v.errors, 1)
+	}
+}
+
+// choose returns the variant of the request: the one of the first override
+// it matches, the one of the backend of its session if the split is sticky,
+// otherwise a random one.
+func (s *split) choose(req *http.Request) *variant {
+	for _, o := range s.overrides {
+		if o.matches(req) {
+			atomic.AddUint64(&o.variant.overridden, 1)
+			return o.variant
+		}
+	}
+	if s.sticky {
+		for _, name := range s.cookies {
+			id, found, err := s.sessions.checkSessionPersistenceCookie(req, name)
+			if !found || err != nil {
+				continue
+			}
+			for _, v := range s.variants {
+				if _, err := v.pool.manager.Backend(id); err == nil {
+					return v
+				}
+			}
+		}
+	}
+	if rand.Float64()*100 < s.getPercent() {
+		return s.variants[1]
+	}
+	return s.variants[0]
+}
+
+func (s *split) status() admin.CanaryStatus {
+	status := admin.CanaryStatus{Route: s.route, Percent: s.getPercent(), Sticky: s.sticky}
+	for _, v := range s.variants {
+		variantStatus := admin.VariantStatus{
+			Name:       v.name,
+			Pool:       v.pool.name,
+			Requests:   atomic.LoadUint64(&v.requests),
+			Errors:     atomic.LoadUint64(&v.errors),
+			Overridden: atomic.LoadUint64(&v.overridden),
+		}
+		if variantStatus.Requests > 0 {
+			variantStatus.ErrorRate = float64(variantStatus.Errors) / float64(variantStatus.Requests)
+		}
+		status.Variants = append(status.Variants, variantStatus)
+	}
+	return status
+}
+
+// Canaries returns the traffic splits of the routes.
+func (r *Router) Canaries() []admin.CanaryStatus {
+	statuses := make([]admin.CanaryStatus, 0, len(r.splits))
+	for _, s := range r.splits {
+		statuses = append(statuses, s.status())
+	}
+	return statuses
+}
+
+// SetCanaryPercent changes the percentage of the requests of the route that
+// are sent to its canary pool.
+func (r *Router) SetCanaryPercent(route string, percent float64) error {
+	for _, s := range r.splits {
+		if s.route == route {
+			return s.setPercent(percent)
+		}
+	}
+	return errors.New(fmt.Sprintf("the route %s has no canary", route))
+}
@@ -0,0 +1,181 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alidn/Yalp/admin"
+)
+
+// canaryConfig splits the route app between the pools v1 and v2.
+func canaryConfig(canary CanaryConfig, primaryURL string, canaryURL string) Config {
+	sessions := SessionPersistenceConfig{ExpirationPeriod: 60}
+	return Config{
+		Pools: []PoolConfig{
+			{Name: "v1", URLs: []string{primaryURL}, SessionPersistenceConfig: sessions},
+			{Name: "v2", URLs: []string{canaryURL}, SessionPersistenceConfig: sessions},
+		},
+		Routes: []RouteConfig{{Name: "app", Pool: "v1", Canary: &canary}},
+	}
+}
+
+func TestCanarySplit(t *testing.T) {
+	primary := newCountingServer()
+	defer primary.Close()
+	canary := newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer canary.Close()
+	router, proxy := newTestRouter(t, canaryConfig(CanaryConfig{Pool: "v2", Percent: 20}, primary.URL, canary.URL))
+
+	makeTestRequests(1000, http.DefaultClient, proxy.URL)
+	AssertInRange(t, primary.count(), 730, 870, "the primary pool should get about 80% of the requests")
+
+	statuses := router.Canaries()
+	if len(statuses) != 1 || len(statuses[0].Variants) != 2 {
+		t.Fatalf("expected one split with two variants, got %+v", statuses)
+	}
+	primaryStatus, canaryStatus := statuses[0].Variants[0], statuses[0].Variants[1]
+	if primaryStatus.Requests != uint64(primary.count()) || primaryStatus.Errors != 0 {
+		t.Errorf("unexpected metrics for the primary variant: %+v", primaryStatus)
+	}
+	if canaryStatus.Requests != uint64(1000-primary.count()) || canaryStatus.ErrorRate != 1 {
+		t.Errorf("unexpected metrics for the canary variant: %+v", canaryStatus)
+	}
+
+	if err := router.SetCanaryPercent("app", 0); err != nil {
+		t.Fatal(err)
+	}
+	before := primary.count()
+	makeTestRequests(100, http.DefaultClient, proxy.URL)
+	if primary.count()-before != 100 {
+		t.Errorf("expected every request on the primary pool, got %d", primary.count()-before)
+	}
+	if err := router.SetCanaryPercent("unknown", 10); err == nil {
+		t.Error("expected an error for a route without a canary")
+	}
+}
+
+func TestStickyCanary(t *testing.T) {
+	primary := newCountingServer()
+	defer primary.Close()
+	canary := newCountingServer()
+	defer canary.Close()
+	_, proxy := newTestRouter(t, canaryConfig(CanaryConfig{Pool: "v2", Percent: 50, Sticky: true}, primary.URL, canary.URL))
+
+	for i := 0; i < 10; i++ {
+		jar, _ := cookiejar.New(nil)
+		primaryBefore, canaryBefore := primary.count(), canary.count()
+		makeTestRequests(10, &http.Client{Jar: jar}, proxy.URL)
+		primaryServed, canaryServed := primary.count()-primaryBefore, canary.count()-canaryBefore
+		if primaryServed != 10 && canaryServed != 10 {
+			t.Fatalf("expected a client to stay on one variant, got %d and %d", primaryServed, canaryServed)
+		}
+	}
+}
+
+func TestCanaryAdminAPI(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+	router, _ := newTestRouter(t, canaryConfig(CanaryConfig{Pool: "v2", Percent: 5}, urls[0], urls[1]))
+	handler, err := admin.NewHandler(router, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/canaries/app", strings.NewReader(`{"percent": 25}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	status := admin.CanaryStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || status.Percent != 25 || router.Canaries()[0].Percent != 25 {
+		t.Errorf("expected the canary to get 25%%, got %d %+v", resp.StatusCode, status)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, server.URL+"/api/canaries/app", strings.NewReader(`{"percent": 101}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a percent above 100, got %d", resp.StatusCode)
+	}
+}
+
+func TestCanaryOverrides(t *testing.T) {
+	primary := newCountingServer()
+	defer primary.Close()
+	canary := newCountingServer()
+	defer canary.Close()
+	router, _ := newTestRouter(t, canaryConfig(CanaryConfig{Pool: "v2", Percent: 50, Overrides: []CanaryOverride{
+		{Header: "X-Canary", Values: []string{"always"}, Pool: "v2"},
+		{Header: "X-User-Id", Values: []string{"42", "43"}, Pool: "v1"},
+		{Cookie: "beta", Pool: "v2"},
+	}}, primary.URL, canary.URL))
+
+	send := func(header string, value string, cookie *http.Cookie) {
+		for i := 0; i < 20; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Test", "1")
+			if header != "" {
+				req.Header.Set(header, value)
+			}
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+	expect := func(primaryCount int, canaryCount int, message string) {
+		t.Helper()
+		if primary.count() != primaryCount || canary.count() != canaryCount {
+			t.Errorf("%s, got %d on the primary pool and %d on the canary one", message, primary.count(), canary.count())
+		}
+	}
+
+	send("X-Canary", "always", nil)
+	expect(0, 20, "expected X-Canary: always to go to the canary pool")
+	send("X-User-Id", "42", nil)
+	expect(20, 20, "expected the pinned user to stay on the primary pool")
+	send("", "", &http.Cookie{Name: "beta", Value: "yes"})
+	expect(20, 40, "expected the beta cookie to go to the canary pool")
+	send("X-Canary", "never", nil)
+	if primary.count() == 20 || canary.count() == 40 {
+		t.Errorf("expected the other values to be split, got %d and %d", primary.count(), canary.count())
+	}
+	if variants := router.Canaries()[0].Variants; variants[0].Overridden != 20 || variants[1].Overridden != 40 {
+		t.Errorf("unexpected override metrics: %+v", variants)
+	}
+}
+
+func TestInvalidCanaryOverrides(t *testing.T) {
+	for _, o := range []CanaryOverride{
+		{Pool: "v2"},
+		{Header: "X-Canary", Cookie: "beta", Pool: "v2"},
+		{Header: "X-Canary", Pool: "v3"},
+	} {
+		config := Config{
+			Pools:  []PoolConfig{{Name: "v1", URLs: []string{"http://127.0.0.1:1"}}, {Name: "v2", URLs: []string{"http://127.0.0.1:2"}}},
+			Routes: []RouteConfig{{Name: "app", Pool: "v1", Canary: &CanaryConfig{Pool: "v2", Overrides: []CanaryOverride{o}}}},
+		}
+		if router, err := NewRouter(context.Background(), config); err == nil {
+			router.Close()
+			t.Errorf("expected an error for the override %+v", o)
+		}
+	}
+}
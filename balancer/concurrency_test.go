@@ -0,0 +1,287 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alidn/Yalp/admin"
+	"github.com/alidn/Yalp/backend"
+	"go.uber.org/goleak"
+)
+
+const (
+	parallelClients   = 50
+	requestsPerClient = 60
+)
+
+// countingServer counts the proxied requests it receives, the health-check
+// requests are ignored because they do not carry the X-Test header.
+type countingServer struct {
+	*httptest.Server
+	served int64
+}
+
+// newProxiedServer serves the proxied requests with handler, the health-check
+// requests do not carry the X-Test header and get an empty 200.
+func newProxiedServer(handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test") != "" {
+			handler(w, r)
+		}
+	}))
+}
+
+func newCountingServer() *countingServer {
+	s := &countingServer{}
+	s.Server = newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.served, 1)
+	})
+	return s
+}
+
+func (s *countingServer) count() int {
+	return int(atomic.LoadInt64(&s.served))
+}
+
+func newCountingServers(n int) ([]*countingServer, []string) {
+	servers := make([]*countingServer, 0, n)
+	urls := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		s := newCountingServer()
+		servers = append(servers, s)
+		urls = append(urls, s.URL)
+	}
+	return servers, urls
+}
+
+func closeServers(servers []*countingServer) {
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
+// makeParallelRequests sends requestsPerClient requests from each of
+// parallelClients goroutines and returns the number of failed requests. If
+// withCookies is set, every client keeps its own cookies.
+func makeParallelRequests(url string, withCookies bool) int {
+	transport := &http.Transport{MaxIdleConnsPerHost: parallelClients}
+	defer transport.CloseIdleConnections()
+
+	var failed int64
+	var wg sync.WaitGroup
+	for c := 0; c < parallelClients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &http.Client{Transport: transport}
+			if withCookies {
+				client.Jar, _ = cookiejar.New(nil)
+			}
+			for i := 0; i < requestsPerClient; i++ {
+				req, _ := http.NewRequest(http.MethodGet, url, nil)
+				req.Header.Set("X-Test", "1")
+				resp, err := client.Do(req)
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return int(failed)
+}
+
+func TestConcurrentRoundRobin(t *testing.T) {
+	servers, urls := newCountingServers(3)
+	defer closeServers(servers)
+
+	loadBalancer, err := NewRoundRobinBalancerWithURLs(context.Background(), urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadBalancer.Close()
+	proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer proxy.Close()
+
+	if failed := makeParallelRequests(proxy.URL, false); failed != 0 {
+		t.Errorf("expected every request to succeed, %d failed", failed)
+	}
+
+	total := parallelClients * requestsPerClient
+	for i, s := range servers {
+		// the index is advanced atomically, so the requests are split evenly.
+		AssertInRange(t, s.count(), total/3-1, total/3+1, "expected an even share of the requests")
+		if status := loadBalancer.BackendStatuses()[i]; status.OpenConnections != 0 {
+			t.Errorf("expected no open connections after the requests, found %d", status.OpenConnections)
+		}
+	}
+}
+
+func TestConcurrentRoundRobinWithSessions(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+
+	loadBalancer, err := NewRoundRobinBalancerWithURLs(context.Background(), urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadBalancer.Close()
+	loadBalancer.Config.SessionPersistenceConfig = SessionPersistenceConfig{Enabled: true, ExpirationPeriod: 60}
+	proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer proxy.Close()
+
+	if failed := makeParallelRequests(proxy.URL, true); failed != 0 {
+		t.Errorf("expected every request to succeed, %d failed", failed)
+	}
+
+	sessions := 0
+	for _, status := range loadBalancer.BackendStatuses() {
+		sessions += status.Sessions
+	}
+	AssertInRange(t, sessions, parallelClients, parallelClients, "expected one session per client")
+}
+
+func TestConcurrentLeastConnections(t *testing.T) {
+	servers, urls := newCountingServers(3)
+	defer closeServers(servers)
+
+	loadBalancer, err := NewLeastConnectionBalancerFromURLs(context.Background(), Config{}, urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadBalancer.Close()
+	proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer proxy.Close()
+
+	if failed := makeParallelRequests(proxy.URL, false); failed != 0 {
+		t.Errorf("expected every request to succeed, %d failed", failed)
+	}
+
+	total := 0
+	for _, s := range servers {
+		total += s.count()
+	}
+	AssertInRange(t, total, parallelClients*requestsPerClient, parallelClients*requestsPerClient,
+		"expected the backends to receive every request")
+	for _, status := range loadBalancer.BackendStatuses() {
+		if status.OpenConnections != 0 {
+			t.Errorf("expected no open connections after the requests, found %d", status.OpenConnections)
+		}
+	}
+}
+
+type managedBalancer interface {
+	Balancer
+	admin.Manager
+}
+
+// TestConcurrentBackendChanges changes the backends through the admin methods
+// while requests are being proxied. The first backend always stays active, so
+// every request must succeed.
+func TestConcurrentBackendChanges(t *testing.T) {
+	constructors := map[string]func(urls ...string) (managedBalancer, error){
+		"round-robin": func(urls ...string) (managedBalancer, error) {
+			return NewRoundRobinBalancerWithURLs(context.Background(), urls...)
+		},
+		"least-connection": func(urls ...string) (managedBalancer, error) {
+			return NewLeastConnectionBalancerFromURLs(context.Background(), Config{}, urls...)
+		},
+	}
+
+	for name, newBalancer := range constructors {
+		t.Run(name, func(t *testing.T) {
+			servers, urls := newCountingServers(3)
+			defer closeServers(servers)
+
+			loadBalancer, err := newBalancer(urls[:2]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer loadBalancer.Close()
+			proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+			defer proxy.Close()
+			second := loadBalancer.BackendStatuses()[1].ID
+
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				states := []backend.AdminState{backend.StateDraining, backend.StateMaintenance, backend.StateActive}
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					case <-time.After(5 * time.Millisecond):
+					}
+					added, err := loadBalancer.NewBackend(backend.Options{URL: urls[2]})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					loadBalancer.AddBackend(added)
+					_ = loadBalancer.SetBackendState(second, states[i%len(states)])
+					_ = loadBalancer.SetBackendState(added.ID(), states[(i+1)%len(states)])
+					_ = loadBalancer.BackendStatuses()
+					if err := loadBalancer.RemoveBackend(added.ID()); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			failed := makeParallelRequests(proxy.URL, false)
+			close(stop)
+			<-done
+			if failed != 0 {
+				t.Errorf("expected every request to succeed, %d failed", failed)
+			}
+		})
+	}
+}
+
+func TestCloseLeaksNoGoroutines(t *testing.T) {
+	constructors := map[string]func(urls ...string) (managedBalancer, error){
+		"round-robin": func(urls ...string) (managedBalancer, error) {
+			return NewRoundRobinBalancerWithURLs(context.Background(), urls...)
+		},
+		"least-connection": func(urls ...string) (managedBalancer, error) {
+			return NewLeastConnectionBalancerFromURLs(context.Background(), Config{}, urls...)
+		},
+	}
+
+	for name, newBalancer := range constructors {
+		t.Run(name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+			servers, urls := newCountingServers(2)
+			defer closeServers(servers)
+
+			loadBalancer, err := newBalancer(urls...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+			if failed := makeParallelRequests(proxy.URL, false); failed != 0 {
+				t.Errorf("expected every request to succeed, %d failed", failed)
+			}
+			added, err := loadBalancer.NewBackend(backend.Options{URL: urls[0]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			loadBalancer.AddBackend(added)
+
+			proxy.Close()
+			loadBalancer.Close()
+		})
+	}
+}
@@ -3,6 +3,10 @@ package balancer
 import (
 	"io/ioutil"
 
+	"github.com/alidn/Yalp/admin"
+	"github.com/alidn/Yalp/backend"
+	"github.com/alidn/Yalp/server"
+	"github.com/alidn/Yalp/tracing"
 	"gopkg.in/yaml.v2"
 )
 
@@ -17,12 +21,105 @@ type SessionPersistenceConfig struct {
 	Enabled bool `yaml:"enabled"`
 	// the cookie expiration time in seconds.
 	ExpirationPeriod int32 `yaml:"expiration_period"`
+	// the keys that sign the cookies, the first one signs the new cookies
+	// and all of them are accepted. A random key is used if there are none.
+	Keys []string `yaml:"keys"`
+	// the backends whose sessions are moved to another backend: unhealthy
+	// (the default), draining for the unhealthy and draining ones, or none.
+	// The backends in maintenance never keep their sessions.
+	Failover string `yaml:"failover"`
+	// derives the ids of the backends from their pool and URL, so that the
+	// sessions survive a restart of Yalp if the keys are set.
+	StableIDs bool `yaml:"stable_ids"`
+	// how the session of a request is found: with a cookie set by Yalp (the
+	// default), by the address of the client with source_ip, by the value
+	// of Header with header, or by the value of Cookie, set by the
+	// backends, with app_cookie.
+	Affinity string `yaml:"affinity"`
+	Header   string `yaml:"header"`
+	Cookie   string `yaml:"cookie"`
+	// the attributes of the cookie of the cookie affinity.
+	SessionCookie SessionCookieConfig `yaml:"session_cookie"`
+	SourceIP      SourceIPConfig      `yaml:"source_ip"`
+	// the most sessions kept in memory by the affinities that are not based
+	// on a cookie, 100000 if it is not set.
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+// SourceIPConfig configures the source_ip affinity.
+type SourceIPConfig struct {
+	// the lengths of the prefixes of the addresses that share a session, e.g.
+	// 24 for IPv4 and 64 for IPv6. The whole addresses if they are not set.
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+	// the sessions end after this many seconds without a request, instead
+	// of the expiration period after they started.
+	IdleTimeout int `yaml:"idle_timeout"`
+}
+
+// SessionCookieConfig sets the attributes of the session persistence cookie.
+type SessionCookieConfig struct {
+	// LoadBalancerSessionCookie if it is not set.
+	Name   string `yaml:"name"`
+	Domain string `yaml:"domain"`
+	// / if it is not set.
+	Path     string `yaml:"path"`
+	Secure   bool   `yaml:"secure"`
+	HTTPOnly bool   `yaml:"http_only"`
+	// lax, strict or none, which requires secure. The attribute is not set
+	// if it is empty.
+	SameSite string `yaml:"same_site"`
+	// the lifetime of the cookie and of its session in seconds, the
+	// expiration period if it is not set.
+	MaxAge int `yaml:"max_age"`
+	// the cookie has no expiry and is dropped when the browser closes. The
+	// session still ends after the max age.
+	SessionOnly bool `yaml:"session_only"`
 }
 
 type Config struct {
 	Algorithm                Algorithm                `yaml:"algorithm"`
 	SessionPersistenceConfig SessionPersistenceConfig `yaml:"session_persistence"`
 	URLs                     []string                 `yaml:"backend_urls"`
+	// the backends with a weight, a zone or tags, in addition to URLs.
+	Backends []backend.Options `yaml:"backends"`
+	// the health-checks of the backends above.
+	HealthCheck backend.HealthCheckConfig `yaml:"health_check"`
+	// the circuit breaker of the backends above.
+	CircuitBreaker backend.CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// the pools the routes can send requests to, in addition to the default
+	// pool made of the backends above.
+	Pools []PoolConfig `yaml:"pools"`
+	// the requests that match no route go to the default pool.
+	Routes []RouteConfig `yaml:"routes"`
+	// how many times a request that could not reach its backend is sent to
+	// another one. Only the requests without a body and with an idempotent
+	// method are retried.
+	Retries int `yaml:"retries"`
+	// the middlewares run around the proxy, in order. The names are the ones
+	// given to RegisterMiddleware.
+	Middlewares []MiddlewareConfig `yaml:"middlewares"`
+	// the header rules of the default pool.
+	HeaderRules HeaderRules `yaml:"header_rules"`
+	// the rewrites of the requests that match no route.
+	Rewrites []RewriteRule `yaml:"rewrites"`
+	// the canary of the requests that match no route.
+	Canary *CanaryConfig `yaml:"canary"`
+	// the mirror of the requests that match no route.
+	Mirror *MirrorConfig `yaml:"mirror"`
+	// the rate limit of the requests that match no route.
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	// the queue of the default pool.
+	Queue QueueConfig `yaml:"queue"`
+	// the addresses or CIDRs of the proxies in front of Yalp. The client of
+	// their requests is taken from X-Forwarded-For by the source_ip affinity
+	// and the rate limits.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// the redirects are answered before the requests are routed.
+	Redirects []RedirectRule `yaml:"redirects"`
+	Tracing   tracing.Config `yaml:"tracing"`
+	Admin     admin.Config   `yaml:"admin"`
+	Shutdown  server.Config  `yaml:"shutdown"`
 }
 
 func ReadConfigFile(filename string) (Config, error) {
@@ -36,3 +133,69 @@ func ReadConfigFile(filename string) (Config, error) {
 
 	return config, err
 }
+
+// BackendOptions returns the options of every backend of the default pool,
+// the ones of URLs first.
+func (c Config) BackendOptions() []backend.Options {
+	return c.DefaultPool().BackendOptions()
+}
+
+// DefaultPool returns the pool made of the backends listed at the top of the
+// config.
+func (c Config) DefaultPool() PoolConfig {
+	return PoolConfig{
+		Name:                     DefaultPool,
+		Algorithm:                c.Algorithm,
+		SessionPersistenceConfig: c.SessionPersistenceConfig,
+		URLs:                     c.URLs,
+		Backends:                 c.Backends,
+		HealthCheck:              c.HealthCheck,
+		CircuitBreaker:           c.CircuitBreaker,
+		HeaderRules:              c.HeaderRules,
+		Queue:                    c.Queue,
+	}
+}
+
+// poolConfig returns the config of the balancer and the proxies of the pool.
+func (c Config) poolConfig(pool PoolConfig) Config {
+	c.Algorithm = pool.Algorithm
+	keys := c.SessionPersistenceConfig.Keys
+	c.SessionPersistenceConfig = pool.SessionPersistenceConfig
+	// the pools share the keys at the top of the config unless they have
+	// their own.
+	if len(c.SessionPersistenceConfig.Keys) == 0 {
+		c.SessionPersistenceConfig.Keys = keys
+	}
+	c.HeaderRules = pool.HeaderRules
+	c.Queue = pool.Queue
+	return c
+}
+
+func redactKeys(keys []string) []string {
+	if keys == nil {
+		return nil
+	}
+	redacted := make([]string, len(keys))
+	for i := range redacted {
+		redacted[i] = "<redacted>"
+	}
+	return redacted
+}
+
+// Redacted returns a copy of the config without secrets, safe to show to
+// operators.
+func (c Config) Redacted() Config {
+	if c.Admin.Token != "" {
+		c.Admin.Token = "<redacted>"
+	}
+	c.SessionPersistenceConfig.Keys = redactKeys(c.SessionPersistenceConfig.Keys)
+	if len(c.Pools) > 0 {
+		pools := make([]PoolConfig, len(c.Pools))
+		copy(pools, c.Pools)
+		for i := range pools {
+			pools[i].SessionPersistenceConfig.Keys = redactKeys(pools[i].SessionPersistenceConfig.Keys)
+		}
+		c.Pools = pools
+	}
+	return c
+}
@@ -0,0 +1,207 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+)
+
+// HeadersMiddleware is the name of the middleware that applies the header
+// rules of the config. It is enabled, after the listed middlewares, when
+// there are header rules.
+const HeadersMiddleware = "headers"
+
+// HeaderRules change the headers of the requests sent to the backends and of
+// the responses sent to the clients, in order.
+type HeaderRules struct {
+	Request  []HeaderRule `yaml:"request"`
+	Response []HeaderRule `yaml:"response"`
+}
+
+// HeaderRule is one change of the headers.
+//
+//	add     adds Value to the header Name
+//	set     replaces the header Name with Value
+//	remove  removes the header Name
+//	rename  moves the values of the header Name to the header To
+//
+// Value can reference the variables ${client_ip}, ${backend_id},
+// ${backend_url}, ${request_id}, ${request_start} (in microseconds since the
+// epoch), ${host}, ${method} and ${path}. The request id is the one of the
+// X-Request-Id header of the client, or a new one.
+type HeaderRule struct {
+	Action string `yaml:"action"`
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value"`
+	To     string `yaml:"to"`
+}
+
+// append returns the rules of r followed by the ones of other.
+func (r HeaderRules) append(other HeaderRules) HeaderRules {
+	return HeaderRules{
+		Request:  append(append([]HeaderRule{}, r.Request...), other.Request...),
+		Response: append(append([]HeaderRule{}, r.Response...), other.Response...),
+	}
+}
+
+func (r HeaderRules) empty() bool {
+	return len(r.Request) == 0 && len(r.Response) == 0
+}
+
+var headerVariable = regexp.MustCompile(`\$\{([a-z_]*)\}`)
+
+var headerVariables = map[string]bool{
+	"client_ip":     true,
+	"backend_id":    true,
+	"backend_url":   true,
+	"request_id":    true,
+	"request_start": true,
+	"host":          true,
+	"method":        true,
+	"path":          true,
+}
+
+func (r HeaderRule) validate() error {
+	if r.Name == "" {
+		return errors.New("a header rule has no name")
+	}
+	switch r.Action {
+	case "add", "set":
+		for _, match := range headerVariable.FindAllStringSubmatch(r.Value, -1) {
+			if !headerVariables[match[1]] {
+				return errors.New(fmt.Sprintf("unknown variable in the header %s: %s", r.Name, match[0]))
+			}
+		}
+	case "remove":
+	case "rename":
+		if r.To == "" {
+			return errors.New(fmt.Sprintf("the rename of the header %s has no target", r.Name))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown action for the header %s: %s", r.Name, r.Action))
+	}
+	return nil
+}
+
+// requestInfo is what the variables of the header rules are made of, it is
+// stored in the context of the request.
+type requestInfo struct {
+	id       string
+	start    time.Time
+	clientIP string
+	host     string
+	method   string
+	path     string
+}
+
+type requestInfoContextKey struct{}
+
+func newHeaders(balancer Balancer, config Config, options map[string]interface{}) (*Middleware, error) {
+	rules := config.HeaderRules
+	for _, list := range [][]HeaderRule{rules.Request, rules.Response} {
+		for _, rule := range list {
+			if err := rule.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &Middleware{
+		Name: HeadersMiddleware,
+		Handler: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				info := &requestInfo{
+					id:       req.Header.Get("X-Request-Id"),
+					start:    time.Now(),
+					clientIP: req.RemoteAddr,
+					host:     req.Host,
+					method:   req.Method,
+					path:     req.URL.Path,
+				}
+				if info.id == "" {
+					info.id = uuid.New().String()
+				}
+				if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+					info.clientIP = host
+				}
+				next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestInfoContextKey{}, info)))
+			})
+		},
+		AfterPick: func(req *http.Request, b backend.Backend, picked bool) {
+			applyHeaderRules(req.Context(), rules.Request, req.Header, b)
+		},
+		OnResponse: func(response *http.Response) error {
+			var b backend.Backend
+			if selected := pickFromContext(response.Request.Context()); selected != nil {
+				b = selected.backend
+			}
+			applyHeaderRules(response.Request.Context(), rules.Response, response.Header, b)
+			return nil
+		},
+	}, nil
+}
+
+func applyHeaderRules(ctx context.Context, rules []HeaderRule, header http.Header, b backend.Backend) {
+	info, _ := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	expand := func(value string) string {
+		return headerVariable.ReplaceAllStringFunc(value, func(variable string) string {
+			return expandHeaderVariable(variable[2:len(variable)-1], info, b)
+		})
+	}
+	for _, rule := range rules {
+		switch rule.Action {
+		case "add":
+			header.Add(rule.Name, expand(rule.Value))
+		case "set":
+			header.Set(rule.Name, expand(rule.Value))
+		case "remove":
+			header.Del(rule.Name)
+		case "rename":
+			values := header.Values(rule.Name)
+			header.Del(rule.Name)
+			for _, value := range values {
+				header.Add(rule.To, value)
+			}
+		}
+	}
+}
+
+func expandHeaderVariable(name string, info *requestInfo, b backend.Backend) string {
+	switch name {
+	case "backend_id":
+		if b != nil {
+			return b.ID().String()
+		}
+		return ""
+	case "backend_url":
+		if b != nil {
+			return b.URL().String()
+		}
+		return ""
+	}
+	if info == nil {
+		return ""
+	}
+	switch name {
+	case "client_ip":
+		return info.clientIP
+	case "request_id":
+		return info.id
+	case "request_start":
+		return strconv.FormatInt(info.start.UnixNano()/int64(time.Microsecond), 10)
+	case "host":
+		return info.host
+	case "method":
+		return info.method
+	case "path":
+		return info.path
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newHeaderEchoServer sends back the headers of the request, prefixed with
+// "Echo-", along with a Server and an X-Powered-By header.
+func newHeaderEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.Header {
+			w.Header()["Echo-"+name] = values
+		}
+		w.Header().Set("Server", "nginx")
+		w.Header().Set("X-Powered-By", "PHP")
+	}))
+}
+
+func TestHeaderRules(t *testing.T) {
+	server := newHeaderEchoServer()
+	defer server.Close()
+	config := Config{
+		Pools: []PoolConfig{{
+			Name: "api",
+			URLs: []string{server.URL},
+			HeaderRules: HeaderRules{
+				Request: []HeaderRule{
+					{Action: "set", Name: "X-Request-Start", Value: "t=${request_start}"},
+					{Action: "set", Name: "X-Backend", Value: "${backend_id}"},
+					{Action: "remove", Name: "X-Secret"},
+				},
+				Response: []HeaderRule{
+					{Action: "remove", Name: "Server"},
+					{Action: "remove", Name: "X-Powered-By"},
+				},
+			},
+		}},
+		Routes: []RouteConfig{{
+			Name: "api",
+			Pool: "api",
+			HeaderRules: HeaderRules{
+				Request: []HeaderRule{
+					{Action: "rename", Name: "X-Old", To: "X-New"},
+					{Action: "add", Name: "X-Client", Value: "${client_ip} ${method} ${path}"},
+				},
+				Response: []HeaderRule{
+					{Action: "set", Name: "X-Request-Id", Value: "${request_id}"},
+					{Action: "add", Name: "X-Frame-Options", Value: "DENY"},
+				},
+			},
+		}},
+	}
+	router, err := NewRouter(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/users", nil)
+	req.Header.Set("X-Secret", "1")
+	req.Header.Set("X-Old", "value")
+	req.Header.Set("X-Request-Id", "abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	api, _ := router.Pool("api")
+	backends := api.(*RoundRobinBalancer).backendPool.List()
+	expected := map[string]string{
+		"Echo-X-Backend":    backends[0].ID().String(),
+		"Echo-X-Secret":     "",
+		"Echo-X-Old":        "",
+		"Echo-X-New":        "value",
+		"Echo-X-Client":     "127.0.0.1 GET /users",
+		"Server":            "",
+		"X-Powered-By":      "",
+		"X-Request-Id":      "abc",
+		"X-Frame-Options":   "DENY",
+		"Echo-X-Request-Id": "abc",
+	}
+	for name, value := range expected {
+		if got := resp.Header.Get(name); got != value {
+			t.Errorf("expected the header %s to be %q, got %q", name, value, got)
+		}
+	}
+	if !strings.HasPrefix(resp.Header.Get("Echo-X-Request-Start"), "t=") {
+		t.Errorf("expected X-Request-Start to be set, got %q", resp.Header.Get("Echo-X-Request-Start"))
+	}
+}
+
+func TestInvalidHeaderRules(t *testing.T) {
+	rules := []HeaderRule{
+		{Action: "replace", Name: "X-Test"},
+		{Action: "set", Name: "X-Test", Value: "${unknown}"},
+		{Action: "rename", Name: "X-Test"},
+		{Action: "remove"},
+	}
+	for _, rule := range rules {
+		config := Config{HeaderRules: HeaderRules{Request: []HeaderRule{rule}}}
+		router, err := NewRouter(context.Background(), config)
+		if err == nil {
+			router.Close()
+			t.Errorf("expected an error for the rule %+v", rule)
+		}
+	}
+}
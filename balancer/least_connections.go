@@ -1,141 +1,84 @@
 package balancer
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"log"
-	"math"
 	"net/http"
-	"net/http/httputil"
-	"sync/atomic"
 
 	"github.com/alidn/Yalp/backend"
-	"github.com/google/uuid"
 )
 
-type BackendWithConnState struct {
-	backend.RoundRobinBackend
-	OpenConnections uint32
+// NewLeastConnectionBalancerFromURLs constructs and returns a
+// LeastConnectionsBalancer for the given list of urls. The health-checks of
+// the backends run until ctx is done or the balancer is closed.
+func NewLeastConnectionBalancerFromURLs(ctx context.Context, config Config, urls ...string) (*LeastConnectionsBalancer, error) {
+	return NewLeastConnectionBalancerWithBackends(ctx, config, Config{URLs: urls}.BackendOptions()...)
 }
 
-func (b *BackendWithConnState) addOpenConnections(delta uint32) {
-	atomic.AddUint32(&b.OpenConnections, delta)
-}
-
-func (b *BackendWithConnState) reduceOpenConnections(delta uint32) {
-	atomic.AddUint32(&b.OpenConnections, ^uint32(delta-1))
-}
-
-type BackendPoolWithConnState struct {
-	Backends []*BackendWithConnState
-}
-
-func (b *BackendPoolWithConnState) getBackend(backendID string) (*BackendWithConnState, error) {
-	backendUUID, err := uuid.Parse(backendID)
-	if err != nil {
-		return nil, err
-	}
-	for _, bckend := range b.Backends {
-		if bckend.Id == backendUUID {
-			return bckend, nil
-		}
-	}
-	return nil, errors.New(fmt.Sprintf("did not find a backend with the given id: %s", backendID))
-}
-
-func NewConnBackendPoolFromURLs(urls ...string) (*BackendPoolWithConnState, error) {
-	pool := &BackendPoolWithConnState{
-		Backends: make([]*BackendWithConnState, 0),
-	}
-	for _, url := range urls {
-		b, err := backend.NewBackend(url)
-		if err != nil {
-			return nil, err
-		}
-		pool.Backends = append(pool.Backends, &BackendWithConnState{
-			RoundRobinBackend: *b,
-			OpenConnections:   0,
-		})
-	}
-	return pool, nil
-}
-
-func NewLeastConnectionBalancerFromURLs(config Config, urls ...string) (*LeastConnectionsBalancer, error) {
-	backendPool, err := NewConnBackendPoolFromURLs(urls...)
+// NewLeastConnectionBalancerWithBackends is like
+// NewLeastConnectionBalancerFromURLs, but it also sets the weight, the zone
+// and the tags of the backends.
+func NewLeastConnectionBalancerWithBackends(ctx context.Context, config Config, options ...backend.Options) (*LeastConnectionsBalancer, error) {
+	backendPool, err := backend.NewBackendPoolFromOptions(ctx, options...)
 	if err != nil {
 		return nil, err
 	}
 	return &LeastConnectionsBalancer{
-		backendPool: *backendPool,
+		managedPool: newManagedPool(ctx, backendPool),
 		Config:      config,
 	}, nil
 }
 
+// LeastConnectionsBalancer sends every request to the backend with the
+// fewest open connections relative to its weight.
 type LeastConnectionsBalancer struct {
-	backendPool BackendPoolWithConnState
-	Config      Config
+	managedPool
+	Config Config
 }
 
-func (l *LeastConnectionsBalancer) NextBackend() (*BackendWithConnState, error) {
-	if len(l.backendPool.Backends) == 0 {
-		return nil, errors.New("there is no backend")
-	}
-	index, minConnections := 0, uint32(math.MaxUint32)
-	for i, b := range l.backendPool.Backends {
-		if b.OpenConnections < minConnections {
-			minConnections = b.OpenConnections
-			index = i
-		}
+func (l *LeastConnectionsBalancer) NewReverseProxy() http.Handler {
+	proxy, err := NewProxy(l, l.Config, l.transport)
+	if err != nil {
+		log.Fatal("could not construct the proxy: ", err)
 	}
-	return l.backendPool.Backends[index], nil
+	return proxy
 }
 
-func attachBackendIDCookie(request *http.Request, backendID uuid.UUID) {
-	cookie := &http.Cookie{
-		Name:  "BackendID",
-		Value: backendID.String(),
+// Pick returns the available backend with the fewest open connections per
+// unit of weight.
+func (l *LeastConnectionsBalancer) Pick(req *http.Request) (backend.Backend, func(Result), error) {
+	b, err := l.next(req)
+	if err != nil {
+		return nil, nil, err
 	}
-	request.AddCookie(cookie)
+	return b, func(Result) {}, nil
 }
 
-func (l *LeastConnectionsBalancer) NewReverseProxy() *httputil.ReverseProxy {
-	director := func(req *http.Request) {
-		nextBackend, err := l.NextBackend()
-		// log.Print(nextBackend.OpenConnections, nextBackend.URL)
-		if err != nil {
-			log.Fatal("Could not get the next backend")
-			return
-		}
-
-		attachBackendIDCookie(req, nextBackend.Id)
-		nextBackend.addOpenConnections(1)
+// NextBackend returns the alive and active backend with the fewest open
+// connections per unit of weight.
+func (l *LeastConnectionsBalancer) NextBackend() (backend.Backend, error) {
+	return l.next(nil)
+}
 
-		targetURL := nextBackend.URL
-		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
-		req.Host = targetURL.Host
-		req.URL.RawQuery = targetURL.RawQuery
-		req.URL.Path = targetURL.Path
+func (l *LeastConnectionsBalancer) next(req *http.Request) (backend.Backend, error) {
+	backends := l.backendPool.List()
+	if len(backends) == 0 {
+		return nil, errors.New("there is no backend")
 	}
-
-	return &httputil.ReverseProxy{
-		Director: director,
-		ModifyResponse: func(response *http.Response) error {
-			go func() error {
-				for _, cookie := range response.Request.Cookies() {
-					if cookie.Name == "BackendID" {
-						backendID := cookie.Value
-						bckend, err := l.backendPool.getBackend(backendID)
-						if err != nil {
-							return err
-						}
-						bckend.reduceOpenConnections(1)
-						return nil
-					}
-				}
-				return nil
-			}()
-			return nil
-		},
+	var next backend.Backend
+	for _, b := range backends {
+		if !available(req, b) {
+			continue
+		}
+		// b has fewer connections per unit of weight than next if
+		// b.InFlight() / b.Weight() < next.InFlight() / next.Weight().
+		if next == nil || b.InFlight()*next.Weight() < next.InFlight()*b.Weight() {
+			next = b
+		}
+	}
+	if next == nil {
+		return nil, errors.New("none of the servers is alive")
 	}
+	return next, nil
 }
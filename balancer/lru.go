@@ -0,0 +1,69 @@
+package balancer
+
+import "container/list"
+
+// lruCache holds at most maxEntries values by key, the least recently used
+// ones are forgotten first. It is not safe for concurrent use.
+type lruCache struct {
+	maxEntries int
+	// the entries, the most recently used one first.
+	entries *list.List
+	keys    map[string]*list.Element
+	// evicted is called with the values forgotten to make room for new ones.
+	// It can be nil.
+	evicted func(key string, value interface{})
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(maxEntries int) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		entries:    list.New(),
+		keys:       make(map[string]*list.Element),
+	}
+}
+
+// get returns the value with the given key, which becomes the most recently
+// used one.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	element, ok := c.keys[key]
+	if !ok {
+		return nil, false
+	}
+	c.entries.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// add sets the value of the given key, which becomes the most recently used
+// one, and forgets the least recently used values over maxEntries.
+func (c *lruCache) add(key string, value interface{}) {
+	if element, ok := c.keys[key]; ok {
+		element.Value.(*lruEntry).value = value
+		c.entries.MoveToFront(element)
+		return
+	}
+	c.keys[key] = c.entries.PushFront(&lruEntry{key: key, value: value})
+	for c.entries.Len() > c.maxEntries {
+		oldest := c.entries.Back().Value.(*lruEntry)
+		c.remove(oldest.key)
+		if c.evicted != nil {
+			c.evicted(oldest.key, oldest.value)
+		}
+	}
+}
+
+// remove forgets the value with the given key.
+func (c *lruCache) remove(key string) {
+	if element, ok := c.keys[key]; ok {
+		c.entries.Remove(element)
+		delete(c.keys, key)
+	}
+}
+
+func (c *lruCache) len() int {
+	return c.entries.Len()
+}
@@ -0,0 +1,137 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/alidn/Yalp/backend"
+)
+
+// Middleware extends the proxy engine. Handler wraps the handling of every
+// request, the hooks are called by the engine around the selection of the
+// backend. Any of them can be nil.
+type Middleware struct {
+	Name    string
+	Handler func(next http.Handler) http.Handler
+	// BeforePick is called before the balancer picks the backend of the
+	// request. If it returns a backend, the request is sent to it and the
+	// balancer is not asked.
+	BeforePick func(req *http.Request) backend.Backend
+	// AfterPick is called once the backend of the request is known, before
+	// the request is sent to it. picked reports whether the balancer picked
+	// the backend, rather than a BeforePick hook.
+	AfterPick func(req *http.Request, b backend.Backend, picked bool)
+	// OnResponse is called with the response of the backend before it is
+	// sent to the client. Returning an error sends a 502 to the client
+	// instead.
+	OnResponse func(response *http.Response) error
+	// OnError is called when no backend could be picked or reached, before
+	// the error is sent to the client.
+	OnError func(req *http.Request, err error)
+}
+
+// MiddlewareConfig enables a middleware in the config.
+type MiddlewareConfig struct {
+	Name    string                 `yaml:"name"`
+	Options map[string]interface{} `yaml:"options"`
+}
+
+// MiddlewareFactory constructs a middleware for a proxy of the balancer.
+// options are the ones set in the config, they can be nil.
+type MiddlewareFactory func(balancer Balancer, config Config, options map[string]interface{}) (*Middleware, error)
+
+var (
+	middlewaresMu sync.RWMutex
+	middlewares   = map[string]MiddlewareFactory{
+		SessionPersistenceMiddleware: newSessionPersistence,
+		HeadersMiddleware:            newHeaders,
+		RewriteMiddleware:            newRewrite,
+	}
+)
+
+// RegisterMiddleware makes a middleware available to the configs under the
+// given name. It panics if the name is already taken.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	if _, ok := middlewares[name]; ok {
+		panic("balancer: the middleware " + name + " is already registered")
+	}
+	middlewares[name] = factory
+}
+
+// Middlewares returns the names of the registered middlewares.
+func Middlewares() []string {
+	middlewaresMu.RLock()
+	defer middlewaresMu.RUnlock()
+	names := make([]string, 0, len(middlewares))
+	for name := range middlewares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newMiddlewares constructs the middlewares enabled in the config, in order.
+// The session persistence middleware comes first if it is enabled by
+// SessionPersistenceConfig but not listed, after the rewrite middleware if
+// there are rewrite rules. The headers middleware comes last if there are
+// header rules. The middlewares enabled this way are skipped if they are
+// listed.
+func newMiddlewares(balancer Balancer, config Config) ([]*Middleware, error) {
+	configs := config.Middlewares
+	if config.SessionPersistenceConfig.Enabled && !hasMiddleware(configs, SessionPersistenceMiddleware) {
+		configs = append([]MiddlewareConfig{{Name: SessionPersistenceMiddleware}}, configs...)
+	}
+	if len(config.Rewrites) > 0 && !hasMiddleware(configs, RewriteMiddleware) {
+		configs = append([]MiddlewareConfig{{Name: RewriteMiddleware}}, configs...)
+	}
+	if !config.HeaderRules.empty() && !hasMiddleware(configs, HeadersMiddleware) {
+		configs = append(append([]MiddlewareConfig{}, configs...), MiddlewareConfig{Name: HeadersMiddleware})
+	}
+
+	middlewaresMu.RLock()
+	defer middlewaresMu.RUnlock()
+	enabled := make([]*Middleware, 0, len(configs))
+	for _, c := range configs {
+		factory, ok := middlewares[c.Name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown middleware: %s", c.Name))
+		}
+		m, err := factory(balancer, config, c.Options)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not construct the middleware %s: %s", c.Name, err))
+		}
+		if m.Name == "" {
+			m.Name = c.Name
+		}
+		enabled = append(enabled, m)
+	}
+	return enabled, nil
+}
+
+func hasMiddleware(configs []MiddlewareConfig, name string) bool {
+	for _, c := range configs {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// intOption returns the option with the given name as an int, or
+// defaultValue if it is not set.
+func intOption(options map[string]interface{}, name string, defaultValue int) (int, error) {
+	value, ok := options[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	n, ok := value.(int)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("the option %s must be an integer", name))
+	}
+	return n, nil
+}
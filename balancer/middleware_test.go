@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alidn/Yalp/backend"
+)
+
+// callLog records the calls of the middlewares of a test.
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(call string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func (l *callLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = nil
+}
+
+func (l *callLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.calls, ",")
+}
+
+// newLoggingMiddleware returns a factory of middlewares that log every call
+// under the name of their option.
+func newLoggingMiddleware(log *callLog) MiddlewareFactory {
+	return func(balancer Balancer, config Config, options map[string]interface{}) (*Middleware, error) {
+		name, _ := options["name"].(string)
+		return &Middleware{
+			Handler: func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					log.add(name + ".handler")
+					next.ServeHTTP(w, req)
+				})
+			},
+			BeforePick: func(req *http.Request) backend.Backend {
+				log.add(name + ".before_pick")
+				return nil
+			},
+			AfterPick: func(req *http.Request, b backend.Backend, picked bool) {
+				if picked {
+					log.add(name + ".after_pick")
+				}
+			},
+			OnResponse: func(response *http.Response) error {
+				log.add(name + ".on_response")
+				return nil
+			},
+			OnError: func(req *http.Request, err error) {
+				log.add(name + ".on_error")
+			},
+		}, nil
+	}
+}
+
+func TestMiddlewaresRunInOrder(t *testing.T) {
+	calls := &callLog{}
+	RegisterMiddleware("test_logging", newLoggingMiddleware(calls))
+
+	server := newCountingServer()
+	defer server.Close()
+	config := Config{Middlewares: []MiddlewareConfig{
+		{Name: "test_logging", Options: map[string]interface{}{"name": "a"}},
+		{Name: "test_logging", Options: map[string]interface{}{"name": "b"}},
+	}}
+	proxy := GetClient(t, config, server.URL)
+	defer proxy.Close()
+
+	makeTestRequests(1, http.DefaultClient, proxy.URL)
+	expected := "a.handler,b.handler,a.before_pick,b.before_pick,a.after_pick,b.after_pick,a.on_response,b.on_response"
+	if calls.String() != expected {
+		t.Errorf("expected the calls %s, got %s", expected, calls)
+	}
+
+	server.Close()
+	calls.reset()
+	makeTestRequests(1, http.DefaultClient, proxy.URL)
+	if !strings.Contains(calls.String(), "a.on_error,b.on_error") {
+		t.Errorf("expected the error hooks to be called, got %s", calls)
+	}
+}
+
+func TestUnknownMiddleware(t *testing.T) {
+	loadBalancer := NewRoundRobinBalancer(context.Background())
+	defer loadBalancer.Close()
+
+	config := Config{Middlewares: []MiddlewareConfig{{Name: "unknown"}}}
+	if _, err := NewProxy(loadBalancer, config, http.DefaultTransport); err == nil {
+		t.Error("expected an error for an unknown middleware")
+	}
+}
+
+func TestSessionPersistenceMiddleware(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+	config := Config{Middlewares: []MiddlewareConfig{
+		{Name: SessionPersistenceMiddleware, Options: map[string]interface{}{"expiration_period": 60}},
+	}}
+	proxy := GetClient(t, config, urls...)
+	defer proxy.Close()
+
+	jar, _ := cookiejar.New(nil)
+	makeTestRequests(10, &http.Client{Jar: jar}, proxy.URL)
+	if servers[0].count() != 10 && servers[1].count() != 10 {
+		t.Errorf("expected every request on the same backend, got %d and %d", servers[0].count(), servers[1].count())
+	}
+}
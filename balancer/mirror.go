@@ -0,0 +1,195 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/alidn/Yalp/admin"
+	"github.com/alidn/Yalp/tracing"
+)
+
+const (
+	defaultMirrorMaxBodySize = 1 << 20
+	// the copies still in flight after this time are canceled.
+	mirrorTimeout = 10 * time.Second
+	// the requests are not mirrored while this many copies are in flight.
+	maxMirrorsInFlight = 64
+)
+
+// MirrorConfig sends a copy of the requests of a route to a shadow pool. The
+// responses of the shadow pool are discarded.
+type MirrorConfig struct {
+	Pool string `yaml:"pool"`
+	// the percentage of the requests that are mirrored, 100 if it is not set.
+	Percent float64 `yaml:"percent"`
+	// the requests with a larger body, in bytes, are not mirrored. 1 MiB if
+	// it is not set.
+	MaxBodySize int64 `yaml:"max_body_size"`
+}
+
+// mirror sends the requests to next and a copy of some of them to a shadow
+// pool, in the background.
+type mirror struct {
+	route       string
+	pool        *pool
+	shadow      http.Handler
+	next        http.Handler
+	percent     float64
+	maxBodySize int64
+	inFlight    int64
+
+	mirrored         uint64
+	skipped          uint64
+	statusMismatches uint64
+	shadowErrors     uint64
+	// the sums of the response times of the mirrored requests, in
+	// nanoseconds, and the number of copies that completed.
+	latency       uint64
+	shadowLatency uint64
+	completed     uint64
+}
+
+func newMirror(route string, config MirrorConfig, p *pool, shadow http.Handler, next http.Handler) (*mirror, error) {
+	if config.Percent < 0 || config.Percent > 100 {
+		return nil, errors.New(fmt.Sprintf("the mirror percent of the route %s must be between 0 and 100", route))
+	}
+	m := &mirror{
+		route:       route,
+		pool:        p,
+		shadow:      shadow,
+		next:        next,
+		percent:     config.Percent,
+		maxBodySize: config.MaxBodySize,
+	}
+	if m.percent == 0 {
+		m.percent = 100
+	}
+	if m.maxBodySize <= 0 {
+		m.maxBodySize = defaultMirrorMaxBodySize
+	}
+	return m, nil
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if rand.Float64()*100 >= m.percent || req.Header.Get("Upgrade") != "" {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+	body, ok := m.bufferBody(req)
+	if !ok || atomic.AddInt64(&m.inFlight, 1) > maxMirrorsInFlight {
+		if ok {
+			atomic.AddInt64(&m.inFlight, -1)
+		}
+		atomic.AddUint64(&m.skipped, 1)
+		m.next.ServeHTTP(w, req)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	copied := req.Clone(ctx)
+	copied.Body = ioutil.NopCloser(bytes.NewReader(body))
+	primary := make(chan mirroredResponse, 1)
+	// the channel is closed without a response if next panics, e.g. with
+	// http.ErrAbortHandler when the client goes away.
+	defer close(primary)
+	go m.send(copied, cancel, primary)
+
+	writer := tracing.NewStatusRecorder(w)
+	start := time.Now()
+	m.next.ServeHTTP(writer, req)
+	primary <- mirroredResponse{status: writer.Status(), latency: time.Since(start)}
+}
+
+type mirroredResponse struct {
+	status  int
+	latency time.Duration
+}
+
+// bufferBody reads the body of the request so that it can be sent twice. It
+// reports false if the body is too large to be mirrored, the request can
+// still be sent to next.
+func (m *mirror) bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > m.maxBodySize {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, m.maxBodySize+1))
+	// the part that was read is sent along with the rest of the body.
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil || int64(len(body)) > m.maxBodySize {
+		return nil, false
+	}
+	return body, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// send sends the copy of a request to the shadow pool and compares its
+// response with the one of the route, which is received from primary. The
+// copies whose primary request was aborted are not compared.
+func (m *mirror) send(req *http.Request, cancel context.CancelFunc, primary <-chan mirroredResponse) {
+	defer atomic.AddInt64(&m.inFlight, -1)
+	defer cancel()
+	atomic.AddUint64(&m.mirrored, 1)
+
+	writer := newDiscardWriter()
+	start := time.Now()
+	m.shadow.ServeHTTP(writer, req)
+	shadowLatency := time.Since(start)
+	if writer.status >= http.StatusInternalServerError {
+		atomic.AddUint64(&m.shadowErrors, 1)
+	}
+
+	response, ok := <-primary
+	if !ok {
+		return
+	}
+	if response.status != writer.status {
+		atomic.AddUint64(&m.statusMismatches, 1)
+	}
+	atomic.AddUint64(&m.latency, uint64(response.latency))
+	atomic.AddUint64(&m.shadowLatency, uint64(shadowLatency))
+	atomic.AddUint64(&m.completed, 1)
+}
+
+func (m *mirror) status() admin.MirrorStatus {
+	status := admin.MirrorStatus{
+		Route:            m.route,
+		Pool:             m.pool.name,
+		Percent:          m.percent,
+		Mirrored:         atomic.LoadUint64(&m.mirrored),
+		Skipped:          atomic.LoadUint64(&m.skipped),
+		StatusMismatches: atomic.LoadUint64(&m.statusMismatches),
+		ShadowErrors:     atomic.LoadUint64(&m.shadowErrors),
+	}
+	if completed := atomic.LoadUint64(&m.completed); completed > 0 {
+		average := func(sum uint64) float64 {
+			return float64(sum) / float64(completed) / float64(time.Millisecond)
+		}
+		status.Latency = average(atomic.LoadUint64(&m.latency))
+		status.ShadowLatency = average(atomic.LoadUint64(&m.shadowLatency))
+	}
+	return status
+}
+
+// Mirrors compares the routes with their shadow pools.
+func (r *Router) Mirrors() []admin.MirrorStatus {
+	statuses := make([]admin.MirrorStatus, 0, len(r.mirrors))
+	for _, m := range r.mirrors {
+		statuses = append(statuses, m.status())
+	}
+	return statuses
+}
@@ -0,0 +1,150 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// shadowServer records the bodies of the proxied requests and answers them
+// slowly with a 500.
+type shadowServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newShadowServer(delay time.Duration) *shadowServer {
+	s := &shadowServer{}
+	s.Server = newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(body))
+		s.mu.Unlock()
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	return s
+}
+
+// mirrorConfig copies the requests of the default pool to the pool shadow.
+func mirrorConfig(mirror MirrorConfig, primaryURL string, shadowURL string) Config {
+	return Config{
+		URLs:   []string{primaryURL},
+		Pools:  []PoolConfig{{Name: "shadow", URLs: []string{shadowURL}}},
+		Mirror: &mirror,
+	}
+}
+
+func postTestRequest(t *testing.T, url string, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("X-Test", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// waitForMirrors waits until count copies completed.
+func waitForMirrors(t *testing.T, router *Router, count uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&router.mirrors[0].completed) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d mirrored requests, got %+v", count, router.mirrors[0].status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	primary := newPathEchoServer()
+	defer primary.Close()
+	shadow := newShadowServer(300 * time.Millisecond)
+	defer shadow.Close()
+	router, proxy := newTestRouter(t, mirrorConfig(MirrorConfig{Pool: "shadow", MaxBodySize: 10}, primary.URL, shadow.URL))
+
+	start := time.Now()
+	resp := postTestRequest(t, proxy.URL+"/orders", "order")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if time.Since(start) > 200*time.Millisecond {
+		t.Errorf("expected the shadow pool not to slow the client down, took %s", time.Since(start))
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "/orders" {
+		t.Errorf("expected the response of the primary pool, got %d %s", resp.StatusCode, body)
+	}
+	resp = postTestRequest(t, proxy.URL, "a body larger than the limit")
+	resp.Body.Close()
+
+	waitForMirrors(t, router, 1)
+	status := router.Mirrors()[0]
+	if status.Mirrored != 1 || status.Skipped != 1 || status.StatusMismatches != 1 || status.ShadowErrors != 1 {
+		t.Errorf("unexpected mirror metrics: %+v", status)
+	}
+	if status.ShadowLatency < 300 || status.Latency >= status.ShadowLatency {
+		t.Errorf("expected the shadow pool to be slower, got %+v", status)
+	}
+	shadow.mu.Lock()
+	defer shadow.mu.Unlock()
+	if len(shadow.bodies) != 1 || shadow.bodies[0] != "order" {
+		t.Errorf("expected the shadow pool to receive a copy of the body, got %q", shadow.bodies)
+	}
+}
+
+func TestMirrorSampling(t *testing.T) {
+	primary := newCountingServer()
+	defer primary.Close()
+	shadow := newShadowServer(0)
+	defer shadow.Close()
+	router, proxy := newTestRouter(t, mirrorConfig(MirrorConfig{Pool: "shadow", Percent: 25}, primary.URL, shadow.URL))
+
+	makeTestRequests(400, http.DefaultClient, proxy.URL)
+	if primary.count() != 400 {
+		t.Errorf("expected every request on the primary pool, got %d", primary.count())
+	}
+	mirrored := router.Mirrors()[0].Mirrored
+	AssertInRange(t, int(mirrored), 60, 140, "about 25% of the requests should be mirrored")
+}
+
+func TestMirrorAbortedRequest(t *testing.T) {
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	aborted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	m, err := newMirror("app", MirrorConfig{}, nil, shadow, aborted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != http.ErrAbortHandler {
+					t.Errorf("expected the panic of the primary handler, got %v", recovered)
+				}
+			}()
+			m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&m.inFlight) != 0 || runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the copies to finish, got %d in flight and %d goroutines instead of %d",
+				atomic.LoadInt64(&m.inFlight), runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mirrored, completed := atomic.LoadUint64(&m.mirrored), atomic.LoadUint64(&m.completed); mirrored != 10 || completed != 0 {
+		t.Errorf("expected 10 copies that are not compared, got %d mirrored and %d completed", mirrored, completed)
+	}
+}
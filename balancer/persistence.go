@@ -0,0 +1,436 @@
+package balancer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+)
+
+// SessionPersistenceCookieName is the default name of the session
+// persistence cookie.
+const SessionPersistenceCookieName string = "LoadBalancerSessionCookie"
+
+// SessionPersistenceMiddleware is the name of the middleware that keeps the
+// requests of a client on the backend that served its first request. It is
+// enabled by SessionPersistenceConfig, its expiration_period option
+// overrides the one of SessionPersistenceConfig.
+const SessionPersistenceMiddleware = "session_persistence"
+
+// The failover modes of the session persistence, see
+// SessionPersistenceConfig.Failover.
+const (
+	FailoverUnhealthy = "unhealthy"
+	FailoverDraining  = "draining"
+	FailoverNone      = "none"
+)
+
+// the shortest session persistence key, in bytes.
+const minSessionKeySize = 16
+
+// defaultSessionKey signs the cookies when no key is configured. It is the
+// same for every pool but changes when Yalp restarts.
+var defaultSessionKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal("could not generate the session persistence key: ", err)
+	}
+	return key
+}()
+
+// sessionClock returns the time the sessions expire against, the tests move
+// it forward to expire the sessions without waiting.
+var sessionClock = time.Now
+
+// sessionSigner signs the session persistence cookies with the first key and
+// accepts the ones signed with any key, so that a key can be rotated by
+// adding the new one first and removing the old one once its cookies
+// expired.
+type sessionSigner struct {
+	keys [][]byte
+}
+
+func newSessionSigner(keys []string) (*sessionSigner, error) {
+	s := &sessionSigner{}
+	for _, key := range keys {
+		if len(key) < minSessionKeySize {
+			return nil, errors.New(fmt.Sprintf("the session persistence keys must have at least %d bytes", minSessionKeySize))
+		}
+		s.keys = append(s.keys, []byte(key))
+	}
+	if len(s.keys) == 0 {
+		s.keys = [][]byte{defaultSessionKey}
+	}
+	return s, nil
+}
+
+// sign returns the value of the cookie of a session on the backend id that
+// expires at expires: the id, the expiry in unix seconds and the signature of
+// both, separated by dots.
+func (s *sessionSigner) sign(id uuid.UUID, expires time.Time) string {
+	payload := id.String() + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + signature(s.keys[0], payload)
+}
+
+// verify returns the backend id of a cookie value, if it is signed with one
+// of the keys and not expired.
+func (s *sessionSigner) verify(value string) (uuid.UUID, error) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return uuid.UUID{}, errors.New("the session cookie is not signed")
+	}
+	payload, sig := value[:i], value[i+1:]
+	valid := false
+	for _, key := range s.keys {
+		if hmac.Equal([]byte(sig), []byte(signature(key, payload))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return uuid.UUID{}, errors.New("the session cookie has an invalid signature")
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return uuid.UUID{}, errors.New("the session cookie is malformed")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	if sessionClock().Unix() >= expires {
+		return uuid.UUID{}, errors.New("the session cookie expired")
+	}
+	return uuid.Parse(parts[0])
+}
+
+func signature(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type sessionPersistence struct {
+	balancer Balancer
+	signer   *sessionSigner
+	failover string
+	// returns the key of the session of a request in table, nil if the
+	// sessions are kept in a cookie.
+	key   func(req *http.Request) string
+	table *affinityTable
+	// the cookie of the backends whose sessions are learned from the
+	// responses, with the app_cookie affinity.
+	appCookie string
+	cookie    SessionCookieConfig
+	sameSite  http.SameSite
+	// the cookie expiration time in seconds.
+	expirationPeriod int
+}
+
+// affinityBalancer is implemented by the balancers that hold the sessions of
+// the affinities that are not based on a cookie.
+type affinityBalancer interface {
+	affinityTable() *affinityTable
+}
+
+func newSessionPersistence(balancer Balancer, config Config, options map[string]interface{}) (*Middleware, error) {
+	expirationPeriod, err := intOption(options, "expiration_period", int(config.SessionPersistenceConfig.ExpirationPeriod))
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newSessionSigner(config.SessionPersistenceConfig.Keys)
+	if err != nil {
+		return nil, err
+	}
+	failover := config.SessionPersistenceConfig.Failover
+	switch failover {
+	case "":
+		failover = FailoverUnhealthy
+	case FailoverUnhealthy, FailoverDraining, FailoverNone:
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown session persistence failover: %s", failover))
+	}
+	clientIP, err := config.clientIPs()
+	if err != nil {
+		return nil, err
+	}
+	key, err := affinityKey(config.SessionPersistenceConfig, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	cookie := config.SessionPersistenceConfig.SessionCookie.withDefaults()
+	sameSite, err := cookie.sameSite()
+	if err != nil {
+		return nil, err
+	}
+	if cookie.MaxAge < 0 {
+		return nil, errors.New("the max age of the session cookie cannot be negative")
+	}
+	s := &sessionPersistence{
+		balancer:         balancer,
+		signer:           signer,
+		failover:         failover,
+		key:              key,
+		cookie:           cookie,
+		sameSite:         sameSite,
+		expirationPeriod: expirationPeriod,
+	}
+	if key != nil {
+		maxSessions := config.SessionPersistenceConfig.MaxSessions
+		if maxSessions <= 0 {
+			maxSessions = defaultMaxSessions
+		}
+		var idleTimeout time.Duration
+		if config.SessionPersistenceConfig.Affinity == AffinitySourceIP {
+			idleTimeout = time.Duration(config.SessionPersistenceConfig.SourceIP.IdleTimeout) * time.Second
+		}
+		// the proxies of a pool share its table, so that the routes to the
+		// pool find the same sessions.
+		if shared, ok := balancer.(affinityBalancer); ok {
+			s.table = shared.affinityTable()
+		} else {
+			s.table = newAffinityTable(maxSessions, idleTimeout)
+		}
+		s.table.configure(maxSessions, idleTimeout, s)
+	}
+	if config.SessionPersistenceConfig.Affinity == AffinityAppCookie {
+		s.appCookie = config.SessionPersistenceConfig.Cookie
+	}
+	return &Middleware{
+		Name: SessionPersistenceMiddleware,
+		Handler: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), newSessionContextKey{}, &newSession{})))
+			})
+		},
+		BeforePick: func(req *http.Request) backend.Backend {
+			b, found := s.checkBackendSession(req)
+			if !found {
+				return nil
+			}
+			return b
+		},
+		AfterPick: func(req *http.Request, b backend.Backend, picked bool) {
+			// no session found, start a new one
+			if picked {
+				s.startSession(req, b)
+			}
+		},
+		OnResponse: func(response *http.Response) error {
+			if s.key == nil {
+				s.setSessionCookie(response)
+			}
+			if s.appCookie != "" {
+				s.learnSession(response)
+			}
+			return nil
+		},
+	}, nil
+}
+
+type newSessionContextKey struct{}
+
+// newSession holds the cookie of the session started by a request, until it
+// is sent to the client with the response.
+type newSession struct {
+	cookie *http.Cookie
+}
+
+// checkSessionPersistenceCookie returns the backend id of the session
+// persistence cookie with the given name. It reports whether the request has
+// one, and an error if it is forged or expired.
+func (s *sessionSigner) checkSessionPersistenceCookie(req *http.Request, name string) (uuid.UUID, bool, error) {
+	for _, cookie := range req.Cookies() {
+		if cookie.Name == name {
+			id, err := s.verify(cookie.Value)
+			if err != nil {
+				return uuid.UUID{}, true, err
+			}
+			return id, true, nil
+		}
+	}
+	return uuid.UUID{}, false, nil
+}
+
+// checkBackendSession returns the backend of the session of the request and
+// whether it has one. The requests whose cookie is forged, expired or signed
+// with a retired key, or whose backend is gone, have none: they are sent to a
+// new backend, and the client gets a new cookie. They are not logged, since
+// any client can send them.
+func (s *sessionPersistence) checkBackendSession(req *http.Request) (backend.Backend, bool) {
+	id, foundSession, err := s.lookupSession(req)
+	if err != nil || !foundSession {
+		return nil, false
+	}
+	nextBackend, err := s.balancer.Backend(id)
+	if err != nil || s.movesSession(nextBackend) {
+		return nil, false
+	}
+	return nextBackend, true
+}
+
+// lookupSession returns the backend id of the session of the request and
+// whether it has one.
+func (s *sessionPersistence) lookupSession(req *http.Request) (uuid.UUID, bool, error) {
+	if s.key == nil {
+		return s.signer.checkSessionPersistenceCookie(req, s.cookie.Name)
+	}
+	key := s.key(req)
+	if key == "" {
+		return uuid.UUID{}, false, nil
+	}
+	id, found := s.table.get(key)
+	return id, found, nil
+}
+
+// learnSession records the session that the backend of the response starts
+// with the application cookie, and forgets the one it ends.
+func (s *sessionPersistence) learnSession(response *http.Response) {
+	selected := pickFromContext(response.Request.Context())
+	if selected == nil || selected.backend == nil {
+		return
+	}
+	for _, cookie := range response.Cookies() {
+		if cookie.Name != s.appCookie {
+			continue
+		}
+		if cookie.Value == "" || cookie.MaxAge < 0 {
+			if key := s.key(response.Request); key != "" {
+				s.table.remove(key)
+			}
+			continue
+		}
+		expires := sessionClock().Add(time.Duration(s.expirationPeriod) * time.Second)
+		if s.table.put(cookie.Value, selected.backend.ID(), expires) {
+			selected.backend.AddSession(expires)
+		}
+	}
+}
+
+// movesSession reports whether the session on b has to start again on
+// another backend.
+func (s *sessionPersistence) movesSession(b backend.Backend) bool {
+	switch {
+	// backends in maintenance do not serve existing sessions either.
+	case b.State() == backend.StateMaintenance:
+		return true
+	case s.failover == FailoverNone:
+		return false
+	case !b.IsAlive():
+		return true
+	}
+	return s.failover == FailoverDraining && b.State() == backend.StateDraining
+}
+
+// startSession starts a new session on b. Its cookie is sent to the client
+// by setSessionCookie. The sessions that are not kept in a cookie are
+// recorded in the table instead.
+func (s *sessionPersistence) startSession(req *http.Request, b backend.Backend) {
+	if s.key != nil {
+		expires := sessionClock().Add(time.Duration(s.expirationPeriod) * time.Second)
+		if s.table.idleTimeout > 0 {
+			expires = sessionClock().Add(s.table.idleTimeout)
+		}
+		if key := s.key(req); key != "" && s.table.put(key, b.ID(), expires) {
+			b.AddSession(expires)
+		}
+		return
+	}
+	// the session lasts as long as its cookie.
+	expires := sessionClock().Add(time.Duration(s.cookieMaxAge()) * time.Second)
+	b.AddSession(expires)
+	if session, ok := req.Context().Value(newSessionContextKey{}).(*newSession); ok {
+		session.cookie = s.createCookie(b.ID(), expires)
+	}
+}
+
+// extendSession keeps the session of the table counted on its backend until
+// its new expiration time.
+func (s *sessionPersistence) extendSession(id uuid.UUID, from time.Time, to time.Time) {
+	if b, err := s.balancer.Backend(id); err == nil {
+		b.ExtendSession(from, to)
+	}
+}
+
+// endSession stops counting the session of the table that ended before it
+// expired on its backend.
+func (s *sessionPersistence) endSession(id uuid.UUID, expires time.Time) {
+	if b, err := s.balancer.Backend(id); err == nil {
+		b.RemoveSession(expires)
+	}
+}
+
+// setSessionCookie sends the cookie of the session started by the request of
+// the response, if there is one.
+func (s *sessionPersistence) setSessionCookie(response *http.Response) {
+	session, ok := response.Request.Context().Value(newSessionContextKey{}).(*newSession)
+	if ok && session.cookie != nil {
+		response.Header.Add("Set-Cookie", session.cookie.String())
+	}
+}
+
+func (s *sessionPersistence) createCookie(id uuid.UUID, expires time.Time) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     s.cookie.Name,
+		Value:    s.signer.sign(id, expires),
+		Domain:   s.cookie.Domain,
+		Path:     s.cookie.Path,
+		Secure:   s.cookie.Secure,
+		HttpOnly: s.cookie.HTTPOnly,
+		SameSite: s.sameSite,
+	}
+	if !s.cookie.SessionOnly {
+		cookie.MaxAge = s.cookieMaxAge()
+		cookie.Expires = sessionClock().Add(time.Duration(cookie.MaxAge) * time.Second)
+	}
+	return cookie
+}
+
+// cookieMaxAge returns the seconds the sessions of the cookie affinity last,
+// the max age of the cookie or the expiration period if it is not set.
+func (s *sessionPersistence) cookieMaxAge() int {
+	if s.cookie.MaxAge > 0 {
+		return s.cookie.MaxAge
+	}
+	return s.expirationPeriod
+}
+
+// withDefaults returns the config with the default name and path set.
+func (c SessionCookieConfig) withDefaults() SessionCookieConfig {
+	if c.Name == "" {
+		c.Name = SessionPersistenceCookieName
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	return c
+}
+
+func (c SessionCookieConfig) sameSite() (http.SameSite, error) {
+	switch strings.ToLower(c.SameSite) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		// browsers reject the cookies with SameSite=None that are not secure.
+		if !c.Secure {
+			return 0, errors.New("the session cookie must be secure to use SameSite=None")
+		}
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown SameSite mode: %s", c.SameSite))
+}
@@ -0,0 +1,299 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+)
+
+func TestSessionSigner(t *testing.T) {
+	id := uuid.New()
+	oldSigner, err := newSessionSigner([]string{"an old key of 16+ bytes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newSessionSigner([]string{"a new key of 16+ bytes", "an old key of 16+ bytes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := signer.sign(id, time.Now().Add(time.Minute))
+	if verified, err := signer.verify(value); err != nil || verified != id {
+		t.Errorf("expected a signed cookie to be valid, got %s %v", verified, err)
+	}
+	if verified, err := signer.verify(oldSigner.sign(id, time.Now().Add(time.Minute))); err != nil || verified != id {
+		t.Errorf("expected a cookie signed with the old key to be valid, got %s %v", verified, err)
+	}
+	if _, err := oldSigner.verify(value); err == nil {
+		t.Error("expected a cookie signed with an unknown key to be invalid")
+	}
+	if _, err := signer.verify(signer.sign(id, time.Now().Add(-time.Second))); err == nil {
+		t.Error("expected an expired cookie to be invalid")
+	}
+	forged := uuid.New().String() + value[strings.IndexByte(value, '.'):]
+	if _, err := signer.verify(forged); err == nil {
+		t.Error("expected a forged cookie to be invalid")
+	}
+	if _, err := signer.verify(id.String()); err == nil {
+		t.Error("expected an unsigned cookie to be invalid")
+	}
+	if _, err := newSessionSigner([]string{"short"}); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
+
+func TestInvalidSessionCookies(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+	config := Config{SessionPersistenceConfig: SessionPersistenceConfig{
+		Enabled:          true,
+		ExpirationPeriod: 60,
+		Keys:             []string{"a key of at least 16 bytes"},
+	}}
+	proxy := GetClient(t, config, urls...)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, value := range []string{uuid.New().String(), "not-a-uuid", uuid.New().String() + ".1.forged"} {
+		before0, before1 := servers[0].count(), servers[1].count()
+		jar, _ := cookiejar.New(nil)
+		jar.SetCookies(proxyURL, []*http.Cookie{{Name: SessionPersistenceCookieName, Value: value}})
+		makeTestRequests(10, &http.Client{Jar: jar}, proxy.URL)
+		served0, served1 := servers[0].count()-before0, servers[1].count()-before1
+		if served0+served1 != 10 {
+			t.Fatalf("expected the requests with the cookie %q to be served, got %d", value, served0+served1)
+		}
+		if served0 != 10 && served1 != 10 {
+			t.Errorf("expected the cookie %q to be replaced by a new session, got %d and %d", value, served0, served1)
+		}
+	}
+	if logs.Len() != 0 {
+		t.Errorf("expected the invalid cookies not to be logged, got %q", logs.String())
+	}
+}
+
+// stateBackend is a backend with a given health and state.
+type stateBackend struct {
+	backend.Backend
+	alive bool
+	state backend.AdminState
+}
+
+func (b stateBackend) IsAlive() bool {
+	return b.alive
+}
+
+func (b stateBackend) State() backend.AdminState {
+	return b.state
+}
+
+func TestSessionFailover(t *testing.T) {
+	tests := []struct {
+		failover string
+		backend  stateBackend
+		moved    bool
+	}{
+		{FailoverUnhealthy, stateBackend{alive: true}, false},
+		{FailoverUnhealthy, stateBackend{alive: false}, true},
+		{FailoverUnhealthy, stateBackend{alive: true, state: backend.StateDraining}, false},
+		{FailoverUnhealthy, stateBackend{alive: true, state: backend.StateMaintenance}, true},
+		{FailoverDraining, stateBackend{alive: true, state: backend.StateDraining}, true},
+		{FailoverDraining, stateBackend{alive: false}, true},
+		{FailoverNone, stateBackend{alive: false, state: backend.StateDraining}, false},
+		{FailoverNone, stateBackend{alive: true, state: backend.StateMaintenance}, true},
+	}
+	for _, test := range tests {
+		s := &sessionPersistence{failover: test.failover}
+		if moved := s.movesSession(test.backend); moved != test.moved {
+			t.Errorf("failover %s, alive %t, %s: expected %t, got %t",
+				test.failover, test.backend.alive, test.backend.state, test.moved, moved)
+		}
+	}
+
+	config := Config{SessionPersistenceConfig: SessionPersistenceConfig{Enabled: true, Failover: "sometimes"}}
+	loadBalancer, _ := NewRoundRobinBalancerWithURLs(context.Background(), "http://127.0.0.1:1")
+	defer loadBalancer.Close()
+	if _, err := NewProxy(loadBalancer, config, http.DefaultTransport); err == nil {
+		t.Error("expected an error for an unknown failover")
+	}
+}
+
+func TestDrainingSessionFailover(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+	router, err := NewRouter(context.Background(), Config{
+		URLs: urls,
+		SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 60,
+			Failover:         FailoverDraining,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	makeTestRequests(5, client, proxy.URL)
+	pinned := 0
+	if servers[1].count() == 5 {
+		pinned = 1
+	}
+	if servers[pinned].count() != 5 {
+		t.Fatalf("expected the session on one backend, got %d and %d", servers[0].count(), servers[1].count())
+	}
+	for _, status := range router.BackendStatuses() {
+		if status.URL == urls[pinned] {
+			if err := router.SetBackendState(status.ID, backend.StateDraining); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	makeTestRequests(5, client, proxy.URL)
+	if servers[1-pinned].count() != 5 {
+		t.Errorf("expected the session to move to the other backend, got %d and %d", servers[0].count(), servers[1].count())
+	}
+}
+
+func TestStableBackendIDs(t *testing.T) {
+	config := Config{
+		URLs:                     []string{"http://127.0.0.1:1", "http://127.0.0.1:2", "http://127.0.0.1:1"},
+		SessionPersistenceConfig: SessionPersistenceConfig{StableIDs: true},
+		Pools: []PoolConfig{{
+			Name:                     "api",
+			URLs:                     []string{"http://127.0.0.1:1"},
+			SessionPersistenceConfig: SessionPersistenceConfig{StableIDs: true},
+		}},
+	}
+	ids := func() map[uuid.UUID]string {
+		router, err := NewRouter(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer router.Close()
+		ids := make(map[uuid.UUID]string)
+		for _, status := range router.BackendStatuses() {
+			ids[status.ID] = status.URL
+		}
+		return ids
+	}
+	first, second := ids(), ids()
+	if len(first) != 4 {
+		t.Errorf("expected every backend to have its own id, got %v", first)
+	}
+	for id, url := range first {
+		if second[id] != url {
+			t.Errorf("expected the id of %s to survive a restart, got %v and %v", url, first, second)
+		}
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+	router, err := NewRouter(context.Background(), Config{
+		URLs: urls,
+		SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 60,
+			SessionCookie: SessionCookieConfig{
+				Name:     "yalp",
+				Domain:   "example.com",
+				Path:     "/app",
+				Secure:   true,
+				HTTPOnly: true,
+				SameSite: "none",
+				MaxAge:   30,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/app", nil)
+	req.Header.Set("X-Test", "1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a single cookie, got %v", recorder.Header()["Set-Cookie"])
+	}
+	cookie := cookies[0]
+	if cookie.Name != "yalp" || cookie.Domain != "example.com" || cookie.Path != "/app" || !cookie.Secure ||
+		!cookie.HttpOnly || cookie.SameSite != http.SameSiteNoneMode || cookie.MaxAge != 30 {
+		t.Errorf("unexpected cookie attributes: %s", recorder.Header().Get("Set-Cookie"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/app", nil)
+	req.Header.Set("X-Test", "1")
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	if setCookie := recorder.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Errorf("expected no cookie for an existing session, got %s", setCookie)
+	}
+}
+
+func TestSessionCookieOutlivesExpirationPeriod(t *testing.T) {
+	servers, urls := newCountingServers(1)
+	defer closeServers(servers)
+	_, proxy := newTestRouter(t, Config{
+		URLs: urls,
+		SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 1,
+			SessionCookie:    SessionCookieConfig{MaxAge: 60},
+		},
+	})
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	makeTestRequests(1, client, proxy.URL)
+	proxyURL, _ := url.Parse(proxy.URL)
+	cookies := jar.Cookies(proxyURL)
+	if len(cookies) != 1 {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+	parts := strings.Split(cookies[0].Value, ".")
+	if expires, _ := strconv.ParseInt(parts[1], 10, 64); expires < time.Now().Add(59*time.Second).Unix() {
+		t.Errorf("expected the session to last as long as the cookie, it expires at %d", expires)
+	}
+}
+
+func TestSessionOnlyCookie(t *testing.T) {
+	sessions := &sessionPersistence{
+		signer:           &sessionSigner{keys: [][]byte{defaultSessionKey}},
+		cookie:           SessionCookieConfig{SessionOnly: true}.withDefaults(),
+		expirationPeriod: 60,
+	}
+	cookie := sessions.createCookie(uuid.New(), time.Now().Add(time.Minute))
+	if cookie.MaxAge != 0 || !cookie.Expires.IsZero() || cookie.Name != SessionPersistenceCookieName || cookie.Path != "/" {
+		t.Errorf("expected a session cookie without expiry, got %s", cookie)
+	}
+
+	for _, c := range []SessionCookieConfig{{SameSite: "none"}, {SameSite: "sometimes"}} {
+		if _, err := c.sameSite(); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
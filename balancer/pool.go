@@ -0,0 +1,123 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+)
+
+// managedPool holds the backends of a balancer and implements the methods of
+// admin.Manager, which are the same for every algorithm.
+type managedPool struct {
+	backendPool *backend.Pool
+	// the health-checks of the backends stop when ctx is done.
+	ctx       context.Context
+	transport *http.Transport
+	// the requests waiting for a backend below its max connections.
+	queue *requestQueue
+	// the sessions of the affinities that are not based on a cookie.
+	sessions *affinityTable
+}
+
+func newManagedPool(ctx context.Context, backendPool *backend.Pool) managedPool {
+	queue := newRequestQueue()
+	for _, b := range backendPool.List() {
+		b.Watch(queue.release)
+	}
+	return managedPool{
+		backendPool: backendPool,
+		ctx:         ctx,
+		transport:   http.DefaultTransport.(*http.Transport).Clone(),
+		queue:       queue,
+		sessions:    newAffinityTable(defaultMaxSessions, 0),
+	}
+}
+
+// busy reports whether a backend of the pool is available but has max
+// connections requests in flight, the requests that could not be picked can
+// then wait in the queue.
+func (p *managedPool) busy() bool {
+	for _, b := range p.backendPool.List() {
+		if full(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// idle reports whether a backend of the pool can take a new request, the new
+// requests can then skip the queue, whose requests may be waiting for other
+// backends.
+func (p *managedPool) idle() bool {
+	for _, b := range p.backendPool.List() {
+		if available(nil, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *managedPool) requestQueue() *requestQueue {
+	return p.queue
+}
+
+func (p *managedPool) affinityTable() *affinityTable {
+	return p.sessions
+}
+
+// Backend returns the backend with the given id.
+func (p *managedPool) Backend(id uuid.UUID) (backend.Backend, error) {
+	return p.backendPool.Get(id)
+}
+
+// AddBackend adds the backend to the balancer.
+func (p *managedPool) AddBackend(b backend.Backend) {
+	b.Watch(p.queue.release)
+	p.backendPool.Add(b)
+	p.queue.release()
+}
+
+// NewBackend constructs a backend whose health-check stops with the balancer.
+// It still has to be added with AddBackend.
+func (p *managedPool) NewBackend(options backend.Options) (backend.Backend, error) {
+	return backend.NewBackendWithOptions(p.ctx, options)
+}
+
+// RemoveBackend removes the backend with the given id and closes it.
+// Requests already proxied to it are not interrupted.
+func (p *managedPool) RemoveBackend(id uuid.UUID) error {
+	removed, err := p.backendPool.Remove(id)
+	if err != nil {
+		return err
+	}
+	removed.Close()
+	return nil
+}
+
+// SetBackendState changes the admin state of the backend with the given id.
+func (p *managedPool) SetBackendState(id uuid.UUID, state backend.AdminState) error {
+	b, err := p.backendPool.Get(id)
+	if err != nil {
+		return err
+	}
+	b.SetState(state)
+	return nil
+}
+
+// BackendStatuses returns a snapshot of the state of every backend.
+func (p *managedPool) BackendStatuses() []backend.Status {
+	backends := p.backendPool.List()
+	statuses := make([]backend.Status, 0, len(backends))
+	for _, b := range backends {
+		statuses = append(statuses, b.Status())
+	}
+	return statuses
+}
+
+// Close closes every backend and the idle connections to them.
+func (p *managedPool) Close() {
+	p.backendPool.Close()
+	p.transport.CloseIdleConnections()
+}
@@ -0,0 +1,425 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/alidn/Yalp/tracing"
+	"github.com/google/uuid"
+)
+
+// errNoBackend is returned to the clients when no backend can serve their
+// request.
+var errNoBackend = errors.New("no backend is available")
+
+// proxy is the engine shared by every algorithm: it asks the balancer for a
+// backend, rewrites the request, runs the hooks of the middlewares, records
+// the metrics of the backends and retries the requests that could not reach
+// their backend.
+type proxy struct {
+	balancer    Balancer
+	config      Config
+	middlewares []*Middleware
+	// the requests wait in the queue of the pool of the balancer when every
+	// backend is at its max connections, if the balancer has one.
+	queued queuedBalancer
+}
+
+// queuedBalancer is implemented by the balancers whose requests can wait
+// for a backend below its max connections.
+type queuedBalancer interface {
+	requestQueue() *requestQueue
+	busy() bool
+	idle() bool
+}
+
+// pick is the backend selected for a request, it is stored in the context of
+// the request.
+type pick struct {
+	backend backend.Backend
+	done    func(Result)
+	start   time.Time
+	// the backends that could not be reached, they are not picked again.
+	tried []uuid.UUID
+	// the path, the query and the headers of the request before it was
+	// sent to the backend, they are sent to the next backend on a retry. The
+	// headers are only kept if the requests are retried.
+	path     string
+	rawQuery string
+	header   http.Header
+	finished bool
+	// set atomically once the request stopped using its backend.
+	released int32
+	err      error
+	// woken up when the request is released, nil if the balancer has no
+	// queue.
+	queue *requestQueue
+}
+
+type pickContextKey struct{}
+
+func pickFromContext(ctx context.Context) *pick {
+	p, _ := ctx.Value(pickContextKey{}).(*pick)
+	return p
+}
+
+// NewProxy returns a handler that sends every request to the backend picked
+// by the balancer, through the middlewares enabled in the config. The first
+// middleware of the config handles the requests first. transport is used to
+// reach the backends.
+func NewProxy(balancer Balancer, config Config, transport http.RoundTripper) (http.Handler, error) {
+	middlewares, err := newMiddlewares(balancer, config)
+	if err != nil {
+		return nil, err
+	}
+	p := &proxy{balancer: balancer, config: config, middlewares: middlewares}
+	if queued, ok := balancer.(queuedBalancer); ok {
+		queued.requestQueue().configure(config.Queue)
+		p.queued = queued
+	}
+	var handler http.Handler = &httputil.ReverseProxy{
+		Director:       p.direct,
+		Transport:      &retryTransport{proxy: p, base: &tracing.Transport{Base: transport}},
+		ErrorHandler:   p.handleError,
+		ModifyResponse: p.modifyResponse,
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i].Handler != nil {
+			handler = middlewares[i].Handler(handler)
+		}
+	}
+	return handler, nil
+}
+
+func (p *proxy) direct(req *http.Request) {
+	_, span := tracing.Start(req.Context(), "yalp.select_backend", tracing.SpanKindInternal)
+	defer span.End()
+	span.SetAttribute("yalp.algorithm", string(p.config.Algorithm))
+
+	selected := &pick{start: time.Now()}
+	*req = *req.WithContext(context.WithValue(req.Context(), pickContextKey{}, selected))
+
+	var queue *requestQueue
+	var picked bool
+	var err error
+	if p.queued != nil {
+		queue = p.queued.requestQueue()
+		selected.queue = queue
+	}
+	// the requests that are already waiting go first, unless a backend is
+	// available: they may be waiting for the backend of their session.
+	if queue == nil || queue.len() == 0 || p.queued.idle() {
+		picked, err = p.acquire(req, selected, span, queue != nil)
+		if err != nil && (queue == nil || !p.queued.busy()) {
+			span.RecordError(err)
+			selected.err = err
+			return
+		}
+	}
+	if selected.backend == nil {
+		err = queue.wait(req.Context(), time.Now().Add(queue.timeout), func() bool {
+			var err error
+			picked, err = p.acquire(req, selected, span, true)
+			return err == nil
+		})
+		if err != nil {
+			span.RecordError(err)
+			selected.err = err
+			return
+		}
+	}
+	selected.path, selected.rawQuery = req.URL.Path, req.URL.RawQuery
+	if p.config.Retries > 0 {
+		selected.header = req.Header.Clone()
+	}
+	p.send(req, selected, span, picked)
+}
+
+// send runs the AfterPick hooks of the middlewares and sends the request to
+// the backend it acquired.
+func (p *proxy) send(req *http.Request, selected *pick, span *tracing.Span, picked bool) {
+	for _, m := range p.middlewares {
+		if m.AfterPick != nil {
+			m.AfterPick(req, selected.backend, picked)
+		}
+	}
+
+	span.SetAttribute("yalp.backend.id", selected.backend.ID().String())
+	span.SetAttribute("yalp.backend.url", selected.backend.URL().String())
+	rewriteURL(req, selected.backend.URL())
+}
+
+// acquire picks the backend of the request and adds the request to the ones
+// in flight on it. If limit is set, it fails with errBackendFull and unsets
+// the backend when the backend already has max connections requests in
+// flight. It reports whether the balancer picked the backend.
+func (p *proxy) acquire(req *http.Request, selected *pick, span *tracing.Span, limit bool) (bool, error) {
+	picked, err := p.pick(req, selected, span)
+	if err != nil {
+		return picked, err
+	}
+	if !limit {
+		// the balancer cannot queue the requests over the max connections
+		// of the backend of their session.
+		selected.backend.AddInFlight(1)
+		return picked, nil
+	}
+	if !selected.backend.TryAddInFlight() {
+		selected.done(Result{Err: errBackendFull})
+		selected.backend, selected.done = nil, nil
+		return picked, errBackendFull
+	}
+	return picked, nil
+}
+
+// pick sets the backend of the request: the one returned by the first
+// middleware whose BeforePick returns one that was not tried yet, or else the
+// one picked by the balancer. It reports whether the balancer picked it.
+func (p *proxy) pick(req *http.Request, selected *pick, span *tracing.Span) (bool, error) {
+	for _, m := range p.middlewares {
+		if m.BeforePick == nil {
+			continue
+		}
+		if b := m.BeforePick(req); b != nil && !selected.hasTried(b.ID()) {
+			selected.backend, selected.done = b, func(Result) {}
+			span.SetAttribute("yalp.picked_by", m.Name)
+			return false, nil
+		}
+	}
+	b, done, err := p.balancer.Pick(req)
+	if err != nil {
+		return true, err
+	}
+	selected.backend, selected.done = b, done
+	return true, nil
+}
+
+// rewriteURL sends the request to targetURL. The path of the request is
+// appended to the one of targetURL, and so is the query.
+func rewriteURL(req *http.Request, targetURL *url.URL) {
+	req.URL.Scheme = targetURL.Scheme
+	req.URL.Host = targetURL.Host
+	req.Host = targetURL.Host
+	req.URL.Path = joinPaths(targetURL.Path, req.URL.Path)
+	req.URL.RawPath = ""
+	if targetURL.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = targetURL.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = targetURL.RawQuery + "&" + req.URL.RawQuery
+	}
+}
+
+func joinPaths(a string, b string) string {
+	if b == "" {
+		if a == "" {
+			return "/"
+		}
+		return a
+	}
+	return strings.TrimSuffix(a, "/") + "/" + strings.TrimPrefix(b, "/")
+}
+
+// hasTried reports whether the request could not reach the backend with the
+// given id before.
+func (p *pick) hasTried(id uuid.UUID) bool {
+	for _, tried := range p.tried {
+		if tried == id {
+			return true
+		}
+	}
+	return false
+}
+
+// finish records the result of the request on its backend and reports it to
+// the balancer. The request still counts toward the requests in flight on the
+// backend until it is released.
+func (p *pick) finish(result Result) {
+	if p.finished || p.backend == nil {
+		return
+	}
+	p.finished = true
+	result.Duration = time.Since(p.start)
+	p.backend.RecordRequest(result.Failed(), result.Duration)
+	p.done(result)
+}
+
+// release removes the request from the requests in flight on its backend and
+// wakes up the next queued request. It is called once the backend could not
+// be reached, or once the body of the response is closed, which is when the
+// tunnel ends for an upgraded connection. Only the first call has an effect.
+func (p *pick) release() {
+	if p.backend == nil || !atomic.CompareAndSwapInt32(&p.released, 0, 1) {
+		return
+	}
+	p.backend.AddInFlight(-1)
+	if p.queue != nil {
+		p.queue.release()
+	}
+}
+
+// releasingBody releases the request of a response when the body of the
+// response is closed.
+type releasingBody struct {
+	io.ReadCloser
+	selected *pick
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.selected.release()
+	return err
+}
+
+// releasingConn is the releasingBody of an upgraded connection, whose body
+// is written to as well.
+type releasingConn struct {
+	*releasingBody
+	io.Writer
+}
+
+// releaseOnClose wraps body so that selected is released when it is closed.
+// The wrapper can still be written to if body can.
+func releaseOnClose(body io.ReadCloser, selected *pick) io.ReadCloser {
+	released := &releasingBody{ReadCloser: body, selected: selected}
+	if w, ok := body.(io.Writer); ok {
+		return releasingConn{releasingBody: released, Writer: w}
+	}
+	return released
+}
+
+func (p *proxy) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	if selected := pickFromContext(req.Context()); selected != nil {
+		selected.finish(Result{Err: err})
+		selected.release()
+	}
+	for _, m := range p.middlewares {
+		if m.OnError != nil {
+			m.OnError(req, err)
+		}
+	}
+	if errors.Is(err, errNoBackend) {
+		log.Print("could not pick a backend: ", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	log.Print("could not reach the backend: ", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func (p *proxy) modifyResponse(response *http.Response) error {
+	if selected := pickFromContext(response.Request.Context()); selected != nil {
+		selected.finish(Result{StatusCode: response.StatusCode})
+		response.Body = releaseOnClose(response.Body, selected)
+	}
+	for _, m := range p.middlewares {
+		if m.OnResponse == nil {
+			continue
+		}
+		if err := m.OnResponse(response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryTransport sends the requests that could not reach their backend to
+// another one, up to Config.Retries times. Only the requests without a body
+// and with an idempotent method are retried.
+type retryTransport struct {
+	proxy *proxy
+	base  http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	selected := pickFromContext(req.Context())
+	if selected == nil {
+		return t.base.RoundTrip(req)
+	}
+	if selected.err != nil {
+		return nil, fmt.Errorf("%w: %s", errNoBackend, selected.err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil || attempt >= t.proxy.config.Retries || !canRetry(req) {
+			return resp, err
+		}
+		log.Printf("could not reach the backend %s, retrying: %s", selected.backend.URL().String(), err)
+		selected.finish(Result{Err: err})
+		selected.release()
+		*selected = pick{
+			start:    time.Now(),
+			tried:    append(selected.tried, selected.backend.ID()),
+			path:     selected.path,
+			rawQuery: selected.rawQuery,
+			header:   selected.header,
+			queue:    selected.queue,
+		}
+		req = req.Clone(req.Context())
+		req.URL.Path, req.URL.RawQuery = selected.path, selected.rawQuery
+		req.Header = selected.header.Clone()
+		if !t.retry(req, selected) {
+			// the error of the attempt is more useful than the one of the
+			// selection.
+			return nil, err
+		}
+	}
+}
+
+// retry selects another backend for a request that could not reach its
+// backend, the way the proxy selected the first one, but without waiting in
+// the queue. It reports whether a backend was acquired.
+func (t *retryTransport) retry(req *http.Request, selected *pick) bool {
+	_, span := tracing.Start(req.Context(), "yalp.select_backend", tracing.SpanKindInternal)
+	defer span.End()
+	span.SetAttribute("yalp.algorithm", string(t.proxy.config.Algorithm))
+	span.SetAttribute("yalp.retry", true)
+
+	picked, err := t.proxy.acquire(req, selected, span, true)
+	if err != nil {
+		span.RecordError(err)
+		return false
+	}
+	t.proxy.send(req, selected, span, picked)
+	return true
+}
+
+func canRetry(req *http.Request) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// available reports whether b can be picked for req: it must be alive,
+// active, with a circuit that is not open, below its max connections and not
+// already tried for the request. req can be nil.
+func available(req *http.Request, b backend.Backend) bool {
+	if !b.IsAlive() || b.State() != backend.StateActive || b.Circuit() == backend.CircuitOpen || full(b) {
+		return false
+	}
+	if req == nil {
+		return true
+	}
+	if selected := pickFromContext(req.Context()); selected != nil {
+		return !selected.hasTried(b.ID())
+	}
+	return true
+}
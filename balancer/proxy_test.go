@@ -0,0 +1,229 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+)
+
+// newBrokenServer answers the health-checks but drops the connection of
+// every proxied request.
+func newBrokenServer() *httptest.Server {
+	return newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+}
+
+func countFailures(count int, url string) int {
+	failed := 0
+	for i := 0; i < count; i++ {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-Test", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			failed++
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			failed++
+		}
+	}
+	return failed
+}
+
+func TestRetryUnreachableBackend(t *testing.T) {
+	broken := newBrokenServer()
+	defer broken.Close()
+	working := newCountingServer()
+	defer working.Close()
+
+	for _, retries := range []int{0, 1} {
+		loadBalancer, err := NewLeastConnectionBalancerFromURLs(context.Background(), Config{Retries: retries},
+			broken.URL, working.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+
+		failed := countFailures(10, proxy.URL)
+		if retries == 0 && failed == 0 {
+			t.Error("expected the requests sent to the broken backend to fail without retries")
+		}
+		if retries == 1 && failed != 0 {
+			t.Errorf("expected every request to be retried on the working backend, %d failed", failed)
+		}
+		for _, status := range loadBalancer.BackendStatuses() {
+			if status.OpenConnections != 0 {
+				t.Errorf("expected no open connections after the requests, found %d", status.OpenConnections)
+			}
+		}
+		proxy.Close()
+		loadBalancer.Close()
+	}
+}
+
+func TestRetryRunsMiddlewares(t *testing.T) {
+	broken := newBrokenServer()
+	defer broken.Close()
+	working := newHeaderEchoServer()
+	defer working.Close()
+	config := Config{
+		Retries: 1,
+		SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 60,
+			Keys:             []string{"a key of at least 16 bytes"},
+		},
+		HeaderRules: HeaderRules{Request: []HeaderRule{{Action: "add", Name: "X-Backend", Value: "${backend_id}"}}},
+	}
+	loadBalancer, err := NewRoundRobinBalancerWithURLs(context.Background(), broken.URL, working.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadBalancer.Close()
+	loadBalancer.Config = config
+	proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer proxy.Close()
+	signer, _ := newSessionSigner(config.SessionPersistenceConfig.Keys)
+	var brokenID, workingID uuid.UUID
+	for _, b := range loadBalancer.backendPool.List() {
+		if b.URL().String() == broken.URL {
+			brokenID = b.ID()
+		} else {
+			workingID = b.ID()
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	req.Header.Set("X-Test", "1")
+	req.AddCookie(&http.Cookie{Name: SessionPersistenceCookieName, Value: signer.sign(brokenID, time.Now().Add(time.Minute))})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the request to be retried on the working backend, got %d", resp.StatusCode)
+	}
+	if backends := resp.Header.Values("Echo-X-Backend"); len(backends) != 1 || backends[0] != workingID.String() {
+		t.Errorf("expected the header rules to name the working backend once, got %v", backends)
+	}
+	var session uuid.UUID
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == SessionPersistenceCookieName {
+			session, _ = signer.verify(cookie.Value)
+		}
+	}
+	if session != workingID {
+		t.Errorf("expected a new session on the working backend, got %s", session)
+	}
+}
+
+func TestNoBackendAvailable(t *testing.T) {
+	loadBalancer := NewRoundRobinBalancer(context.Background())
+	defer loadBalancer.Close()
+	proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected %d without backends, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+// recordingBalancer is a Balancer built on another one, it records the
+// results reported by the proxy engine.
+type recordingBalancer struct {
+	*RoundRobinBalancer
+	mu      sync.Mutex
+	results []Result
+}
+
+func (b *recordingBalancer) Pick(req *http.Request) (backend.Backend, func(Result), error) {
+	picked, _, err := b.RoundRobinBalancer.Pick(req)
+	return picked, func(result Result) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.results = append(b.results, result)
+	}, err
+}
+
+func TestProxyReportsResults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	roundRobin, err := NewRoundRobinBalancerWithURLs(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roundRobin.Close()
+	loadBalancer := &recordingBalancer{RoundRobinBalancer: roundRobin}
+	handler, err := NewProxy(loadBalancer, Config{}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	for _, fail := range []string{"", "1"} {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		req.Header.Set("X-Fail", fail)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if len(loadBalancer.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(loadBalancer.results))
+	}
+	if loadBalancer.results[0].Failed() || !loadBalancer.results[1].Failed() {
+		t.Errorf("expected only the second request to fail, got %+v", loadBalancer.results)
+	}
+	if status := roundRobin.BackendStatuses()[0]; status.Requests != 2 || status.Errors != 1 {
+		t.Errorf("expected 2 requests and 1 error to be recorded, got %d and %d", status.Requests, status.Errors)
+	}
+}
+
+func TestOpenCircuitIsSkipped(t *testing.T) {
+	failing := newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer failing.Close()
+	working := newCountingServer()
+	defer working.Close()
+	breaker := backend.CircuitBreakerConfig{Failures: 1, OpenTimeout: 60}
+	loadBalancer, err := NewRoundRobinBalancerWithBackends(context.Background(),
+		backend.Options{URL: failing.URL, CircuitBreaker: breaker}, backend.Options{URL: working.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadBalancer.Close()
+	proxy := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer proxy.Close()
+
+	if failed := countFailures(10, proxy.URL); failed != 1 {
+		t.Errorf("expected only the first request to the failing backend to fail, %d failed", failed)
+	}
+	if circuit := loadBalancer.BackendStatuses()[0].Circuit; circuit != backend.CircuitOpen.String() {
+		t.Errorf("expected the circuit of the failing backend to be open, got %s", circuit)
+	}
+}
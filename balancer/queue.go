@@ -0,0 +1,180 @@
+package balancer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alidn/Yalp/admin"
+	"github.com/alidn/Yalp/backend"
+)
+
+const (
+	defaultQueueLength  = 100
+	defaultQueueTimeout = 10 * time.Second
+)
+
+var (
+	errQueueFull    = errors.New("every backend is at its max connections and the queue is full")
+	errQueueTimeout = errors.New("every backend stayed at its max connections until the queue timeout")
+	errBackendFull  = errors.New("the backend is at its max connections")
+)
+
+// QueueConfig configures the queue of the requests that wait for a backend
+// of a pool when every backend has max_connections requests in flight.
+type QueueConfig struct {
+	// the most requests waiting, 100 if it is not set. The other ones get a
+	// 503.
+	MaxLength int `yaml:"max_length"`
+	// the seconds a request waits before it gets a 503, 10 if it is not set.
+	Timeout int `yaml:"timeout"`
+}
+
+// requestQueue holds the requests waiting for a backend of a pool. The oldest
+// one tries to take a backend first, every time a request of the pool
+// finishes or a backend becomes available. A request that cannot take one,
+// such as a request whose session is on a full backend, passes its turn to
+// the next one, so the requests that can use a backend get it in FIFO order
+// without waiting behind the ones that cannot.
+type requestQueue struct {
+	configured sync.Once
+	maxLength  int
+	timeout    time.Duration
+
+	mu sync.Mutex
+	// the channels signaled to wake up the waiting requests, the oldest one
+	// first.
+	waiters *list.List
+
+	overflows uint64
+	timeouts  uint64
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{waiters: list.New()}
+}
+
+// configure sets the length and the timeout of the queue, only the first
+// call has an effect. The queue is shared by the proxies of the pool, which
+// have the same config.
+func (q *requestQueue) configure(config QueueConfig) {
+	q.configured.Do(func() {
+		q.maxLength = config.MaxLength
+		if q.maxLength <= 0 {
+			q.maxLength = defaultQueueLength
+		}
+		q.timeout = time.Duration(config.Timeout) * time.Second
+		if q.timeout <= 0 {
+			q.timeout = defaultQueueTimeout
+		}
+	})
+}
+
+// wait waits until acquire takes a backend for the request, or until
+// deadline. acquire is called under the lock of the queue when the request is
+// the oldest one or when it gets the turn of the one ahead of it, so a
+// backend that becomes available between a failed call and the next wake up
+// cannot be missed.
+func (q *requestQueue) wait(ctx context.Context, deadline time.Time, acquire func() bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiters.Len() >= q.maxLength {
+		atomic.AddUint64(&q.overflows, 1)
+		return errQueueFull
+	}
+	ready := make(chan struct{}, 1)
+	element := q.waiters.PushBack(ready)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	turn := q.waiters.Front() == element
+	for {
+		if turn {
+			if acquire() {
+				q.waiters.Remove(element)
+				// another backend may be available for the next request.
+				q.wakeNext()
+				return nil
+			}
+			// the next request may be able to take another backend.
+			q.wake(element.Next())
+		}
+
+		q.mu.Unlock()
+		var err error
+		select {
+		case <-ready:
+		case <-timer.C:
+			atomic.AddUint64(&q.timeouts, 1)
+			err = errQueueTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		q.mu.Lock()
+
+		if err != nil {
+			q.waiters.Remove(element)
+			// the next request takes the turn of this one.
+			q.wakeNext()
+			return err
+		}
+		turn = true
+	}
+}
+
+// release wakes up the oldest waiting request, a backend of the pool may be
+// available.
+func (q *requestQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wakeNext()
+}
+
+func (q *requestQueue) wakeNext() {
+	q.wake(q.waiters.Front())
+}
+
+// wake wakes up the waiting request of the element, which can be nil.
+func (q *requestQueue) wake(element *list.Element) {
+	if element == nil {
+		return
+	}
+	select {
+	case element.Value.(chan struct{}) <- struct{}{}:
+	default:
+		// it is already woken up.
+	}
+}
+
+func (q *requestQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len()
+}
+
+// full reports whether b is available but has max connections requests in
+// flight.
+func full(b backend.Backend) bool {
+	return b.IsAlive() && b.State() == backend.StateActive &&
+		b.MaxConnections() > 0 && b.InFlight() >= b.MaxConnections()
+}
+
+// Queues returns the queues of the requests waiting for a backend of every
+// pool.
+func (r *Router) Queues() []admin.QueueStatus {
+	statuses := make([]admin.QueueStatus, 0, len(r.pools))
+	for _, p := range r.pools {
+		q := p.manager.queue
+		statuses = append(statuses, admin.QueueStatus{
+			Pool:      p.name,
+			Length:    q.len(),
+			MaxLength: q.maxLength,
+			Overflows: atomic.LoadUint64(&q.overflows),
+			Timeouts:  atomic.LoadUint64(&q.timeouts),
+		})
+	}
+	return statuses
+}
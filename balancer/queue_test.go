@@ -0,0 +1,374 @@
+package balancer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alidn/Yalp/backend"
+)
+
+// newGateServer answers the proxied requests once release is closed.
+func newGateServer(release chan struct{}) *httptest.Server {
+	return newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+}
+
+// queueConfig caps the backend at one connection and queues the other
+// requests.
+func queueConfig(url string, queue QueueConfig) Config {
+	return Config{
+		Backends: []backend.Options{{URL: url, MaxConnections: 1}},
+		Queue:    queue,
+	}
+}
+
+// sendAsync sends a request and returns its status on the channel.
+func sendAsync(url string) chan int {
+	return sendAsyncWithCookie(url, nil)
+}
+
+// sendAsyncWithCookie is like sendAsync, but the request carries the cookie
+// if it is not nil.
+func sendAsyncWithCookie(url string, cookie *http.Cookie) chan int {
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-Test", "1")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	return status
+}
+
+// waitForQueue waits until length requests are queued.
+func waitForQueue(t *testing.T, router *Router, length int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for router.Queues()[0].Length != length {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued requests, got %+v", length, router.Queues()[0])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	release := make(chan struct{})
+	server := newGateServer(release)
+	defer server.Close()
+	router, proxy := newTestRouter(t, queueConfig(server.URL, QueueConfig{MaxLength: 1, Timeout: 5}))
+
+	first := sendAsync(proxy.URL)
+	deadline := time.Now().Add(5 * time.Second)
+	for router.BackendStatuses()[0].OpenConnections != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	second := sendAsync(proxy.URL)
+	waitForQueue(t, router, 1)
+
+	if status := <-sendAsync(proxy.URL); status != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 when the queue is full, got %d", status)
+	}
+	if router.BackendStatuses()[0].OpenConnections != 1 {
+		t.Errorf("expected the backend to stay at its max connections, got %+v", router.BackendStatuses()[0])
+	}
+	close(release)
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("expected the first request to be served, got %d", status)
+	}
+	if status := <-second; status != http.StatusOK {
+		t.Errorf("expected the queued request to be served, got %d", status)
+	}
+	if status := router.Queues()[0]; status.Pool != DefaultPool || status.Length != 0 || status.MaxLength != 1 || status.Overflows != 1 {
+		t.Errorf("unexpected queue status: %+v", status)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newGateServer(release)
+	defer server.Close()
+	defer close(release)
+	router, proxy := newTestRouter(t, queueConfig(server.URL, QueueConfig{Timeout: 1}))
+
+	sendAsync(proxy.URL)
+	deadline := time.Now().Add(5 * time.Second)
+	for router.BackendStatuses()[0].OpenConnections != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	start := time.Now()
+	if status := <-sendAsync(proxy.URL); status != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 after the timeout, got %d", status)
+	}
+	if waited := time.Since(start); waited < time.Second || waited > 3*time.Second {
+		t.Errorf("expected the request to wait for the timeout, waited %s", waited)
+	}
+	if status := router.Queues()[0]; status.Timeouts != 1 || status.MaxLength != defaultQueueLength {
+		t.Errorf("unexpected queue status: %+v", status)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := newRequestQueue()
+	q.configure(QueueConfig{Timeout: 5})
+
+	// free and served are only accessed under the lock of the queue.
+	free := 0
+	var served []int
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		go func() {
+			results <- q.wait(context.Background(), time.Now().Add(5*time.Second), func() bool {
+				if free == 0 {
+					return false
+				}
+				free--
+				served = append(served, i)
+				return true
+			})
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for q.len() != i+1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		q.mu.Lock()
+		free++
+		q.mu.Unlock()
+		q.release()
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(served) != 3 || served[0] != 0 || served[1] != 1 || served[2] != 2 {
+		t.Errorf("expected the requests to be served in FIFO order, got %v", served)
+	}
+}
+
+func TestQueueBackendActivated(t *testing.T) {
+	release := make(chan struct{})
+	gate := newGateServer(release)
+	defer gate.Close()
+	spareServer := newCountingServer()
+	defer spareServer.Close()
+
+	router, proxy := newTestRouter(t, Config{
+		Backends: []backend.Options{
+			{URL: gate.URL, MaxConnections: 1},
+			{URL: spareServer.URL},
+		},
+		Queue: QueueConfig{Timeout: 5},
+	})
+	defer close(release)
+	spare := router.BackendStatuses()[1].ID
+	if err := router.SetBackendState(spare, backend.StateMaintenance); err != nil {
+		t.Fatal(err)
+	}
+
+	sendAsync(proxy.URL)
+	deadline := time.Now().Add(5 * time.Second)
+	for router.BackendStatuses()[0].OpenConnections != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	queued := sendAsync(proxy.URL)
+	waitForQueue(t, router, 1)
+
+	start := time.Now()
+	if err := router.SetBackendState(spare, backend.StateActive); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-queued; status != http.StatusOK {
+		t.Errorf("expected the queued request to be served by the activated backend, got %d", status)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("expected the queued request to be woken up when the backend was activated, waited %s", waited)
+	}
+	if spareServer.count() != 1 {
+		t.Errorf("expected the activated backend to serve 1 request, got %d", spareServer.count())
+	}
+}
+
+func TestQueuedSessionDoesNotBlockPool(t *testing.T) {
+	releasePinned, releaseOther := make(chan struct{}), make(chan struct{})
+	pinnedServer, otherServer := newGateServer(releasePinned), newGateServer(releaseOther)
+	defer pinnedServer.Close()
+	defer otherServer.Close()
+	keys := []string{"a key of at least 16 bytes"}
+	router, proxy := newTestRouter(t, Config{
+		Backends: []backend.Options{
+			{URL: pinnedServer.URL, MaxConnections: 1},
+			{URL: otherServer.URL, MaxConnections: 1},
+		},
+		SessionPersistenceConfig: SessionPersistenceConfig{Enabled: true, ExpirationPeriod: 60, Keys: keys},
+		Queue:                    QueueConfig{Timeout: 5},
+	})
+	defer close(releasePinned)
+	var releasedOther sync.Once
+	closeOther := func() { releasedOther.Do(func() { close(releaseOther) }) }
+	defer closeOther()
+	signer, _ := newSessionSigner(keys)
+	session := &http.Cookie{
+		Name:  SessionPersistenceCookieName,
+		Value: signer.sign(router.BackendStatuses()[0].ID, time.Now().Add(time.Minute)),
+	}
+
+	sendAsyncWithCookie(proxy.URL, session)
+	waitForConnections(t, router, 1)
+	pinned := sendAsyncWithCookie(proxy.URL, session)
+	waitForQueue(t, router, 1)
+
+	// the other backend is idle, the new client does not wait behind the
+	// session.
+	start := time.Now()
+	other := sendAsync(proxy.URL)
+	deadline := time.Now().Add(2 * time.Second)
+	for router.BackendStatuses()[1].OpenConnections != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the new client to reach the idle backend, got %+v", router.Queues()[0])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// every backend is full, the next client waits behind the session and
+	// takes the other backend once it is released.
+	queued := sendAsync(proxy.URL)
+	waitForQueue(t, router, 2)
+	closeOther()
+	if status := <-other; status != http.StatusOK {
+		t.Errorf("expected the new client to be served, got %d", status)
+	}
+	if status := <-queued; status != http.StatusOK {
+		t.Errorf("expected the queued client to be served, got %d", status)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("expected the clients not to wait for the session, waited %s", waited)
+	}
+	select {
+	case status := <-pinned:
+		t.Errorf("expected the session to wait for its backend, got %d", status)
+	default:
+	}
+}
+
+// newStreamingServer sends the headers of its responses right away and ends
+// their body once release is closed. It switches the protocol of the
+// requests that ask for it and echoes the tunnel.
+func newStreamingServer(release chan struct{}) *httptest.Server {
+	return newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "echo" {
+			conn, buffered, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			buffered.Flush()
+			io.Copy(conn, buffered)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "done")
+	})
+}
+
+// waitForConnections waits until the backend has open requests in flight.
+func waitForConnections(t *testing.T, router *Router, open int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for router.BackendStatuses()[0].OpenConnections != open {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d open connections, got %+v", open, router.BackendStatuses()[0])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueStreamedBody(t *testing.T) {
+	release := make(chan struct{})
+	var released sync.Once
+	end := func() { released.Do(func() { close(release) }) }
+	server := newStreamingServer(release)
+	defer server.Close()
+	defer end()
+	router, proxy := newTestRouter(t, queueConfig(server.URL, QueueConfig{Timeout: 5}))
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	req.Header.Set("X-Test", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	queued := sendAsync(proxy.URL)
+	// the body of the first response is still being streamed.
+	waitForQueue(t, router, 1)
+	waitForConnections(t, router, 1)
+
+	end()
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "done" {
+		t.Errorf("expected the streamed body, got %q, %v", body, err)
+	}
+	if status := <-queued; status != http.StatusOK {
+		t.Errorf("expected the queued request to be served once the body ended, got %d", status)
+	}
+	waitForConnections(t, router, 0)
+}
+
+func TestQueueUpgradedConnection(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	server := newStreamingServer(release)
+	defer server.Close()
+	router, proxy := newTestRouter(t, queueConfig(server.URL, QueueConfig{Timeout: 5}))
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: yalp\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Test: 1\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the protocol to be switched, got %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("expected the tunnel to echo, got %q, %v", line, err)
+	}
+	queued := sendAsync(proxy.URL)
+	// the tunnel is still open.
+	waitForQueue(t, router, 1)
+	waitForConnections(t, router, 1)
+
+	conn.Close()
+	if status := <-queued; status != http.StatusOK {
+		t.Errorf("expected the queued request to be served once the tunnel ended, got %d", status)
+	}
+	waitForConnections(t, router, 0)
+}
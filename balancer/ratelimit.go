@@ -0,0 +1,153 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The keys of the rate limits, see RateLimitConfig.Key.
+const (
+	RateLimitByClientIP = "client_ip"
+	RateLimitByHeader   = "header"
+	RateLimitByRoute    = "route"
+)
+
+// the most clients whose buckets are kept by default.
+const defaultMaxRateLimitClients = 100000
+
+// RateLimitConfig limits the rate of the requests of every client of a
+// route with a token bucket. The requests over the limit are answered with a
+// 429 without reaching a backend.
+type RateLimitConfig struct {
+	// client_ip (the default), header, or route to limit every request of the
+	// route together.
+	Key string `yaml:"key"`
+	// the header that identifies the clients with the header key, e.g. an API
+	// key. The requests without it are limited by client IP.
+	Header string `yaml:"header"`
+	// the requests per second.
+	Rate float64 `yaml:"rate"`
+	// the requests a client can send at once, the rate rounded up if it is
+	// not set.
+	Burst int `yaml:"burst"`
+	// the most clients whose buckets are kept, the least recently seen ones
+	// are forgotten first. 100000 if it is not set.
+	MaxClients int `yaml:"max_clients"`
+}
+
+// rateLimiter sends the requests to next as long as their client has tokens
+// left.
+type rateLimiter struct {
+	next    http.Handler
+	key     func(req *http.Request) string
+	rate    float64
+	burst   float64
+	buckets *bucketStore
+}
+
+// newRateLimiter limits the requests of the route, clientIP returns the
+// address of the client of a request.
+func newRateLimiter(route string, config RateLimitConfig, clientIP func(req *http.Request) net.IP, next http.Handler) (*rateLimiter, error) {
+	if config.Rate <= 0 {
+		return nil, errors.New(fmt.Sprintf("the rate limit of the route %s must have a positive rate", route))
+	}
+	if config.Burst < 0 {
+		return nil, errors.New(fmt.Sprintf("the rate limit burst of the route %s cannot be negative", route))
+	}
+	byClientIP := func(req *http.Request) string {
+		if ip := clientIP(req); ip != nil {
+			return ip.String()
+		}
+		return req.RemoteAddr
+	}
+	l := &rateLimiter{next: next, rate: config.Rate, burst: float64(config.Burst)}
+	switch config.Key {
+	case "", RateLimitByClientIP:
+		l.key = byClientIP
+	case RateLimitByHeader:
+		if config.Header == "" {
+			return nil, errors.New(fmt.Sprintf("the rate limit of the route %s requires a header", route))
+		}
+		name := http.CanonicalHeaderKey(config.Header)
+		l.key = func(req *http.Request) string {
+			if value := req.Header.Get(name); value != "" {
+				return name + ":" + value
+			}
+			return byClientIP(req)
+		}
+	case RateLimitByRoute:
+		l.key = func(req *http.Request) string {
+			return route
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown rate limit key: %s", config.Key))
+	}
+	if l.burst == 0 {
+		l.burst = math.Ceil(l.rate)
+	}
+	maxClients := config.MaxClients
+	if maxClients <= 0 {
+		maxClients = defaultMaxRateLimitClients
+	}
+	l.buckets = newBucketStore(maxClients)
+	return l, nil
+}
+
+func (l *rateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	allowed, tokens := l.buckets.take(l.key(req), l.rate, l.burst, time.Now())
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(int(l.burst)))
+	header.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	// the seconds until the bucket is full again.
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((l.burst-tokens)/l.rate))))
+	if !allowed {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil((1-tokens)/l.rate))))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	l.next.ServeHTTP(w, req)
+}
+
+// bucketStore holds the token buckets of the clients.
+type bucketStore struct {
+	mu sync.Mutex
+	// the *bucket of the clients by key.
+	buckets *lruCache
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newBucketStore(maxBuckets int) *bucketStore {
+	return &bucketStore{buckets: newLRUCache(maxBuckets)}
+}
+
+// take takes a token from the bucket with the given key, which gets rate
+// tokens per second up to burst. It reports whether there was one, and the
+// tokens left.
+func (s *bucketStore) take(key string, rate float64, burst float64, now time.Time) (bool, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b *bucket
+	if value, ok := s.buckets.get(key); ok {
+		b = value.(*bucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	} else {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets.add(key, b)
+	}
+	if b.tokens < 1 {
+		return false, b.tokens
+	}
+	b.tokens--
+	return true, b.tokens
+}
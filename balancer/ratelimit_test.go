@@ -0,0 +1,108 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBucketStore(t *testing.T) {
+	store := newBucketStore(2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := store.take("a", 1, 2, now); !ok {
+			t.Fatalf("expected request %d to be allowed by the burst", i)
+		}
+	}
+	if ok, tokens := store.take("a", 1, 2, now); ok || tokens != 0 {
+		t.Errorf("expected an empty bucket, got %t with %g tokens", ok, tokens)
+	}
+	if ok, _ := store.take("a", 1, 2, now.Add(time.Second)); !ok {
+		t.Error("expected the bucket to get a token after a second")
+	}
+	if ok, _ := store.take("a", 1, 2, now.Add(time.Second)); ok {
+		t.Error("expected the bucket to be empty again")
+	}
+
+	store.take("b", 1, 2, now)
+	store.take("c", 1, 2, now)
+	if _, ok := store.buckets.get("a"); ok || store.buckets.len() != 2 {
+		t.Errorf("expected the least recently used bucket to be forgotten, got %d buckets", store.buckets.len())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := newCountingServer()
+	defer server.Close()
+	router, err := NewRouter(context.Background(), Config{
+		URLs: []string{server.URL},
+		Routes: []RouteConfig{
+			{Name: "api", PathPrefix: "/api", RateLimit: &RateLimitConfig{Key: RateLimitByHeader, Header: "X-Api-Key", Rate: 1, Burst: 3}},
+		},
+		RateLimit: &RateLimitConfig{Rate: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	send := func(path string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Test", "1")
+		req.Header.Set("X-Api-Key", key)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	for i := 0; i < 3; i++ {
+		recorder := send("/api", "first")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected request %d to be allowed, got %d", i, recorder.Code)
+		}
+	}
+	recorder := send("/api", "first")
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 over the limit, got %d", recorder.Code)
+	}
+	header := recorder.Header()
+	if header.Get("Retry-After") != "1" || header.Get("RateLimit-Limit") != "3" ||
+		header.Get("RateLimit-Remaining") != "0" || header.Get("RateLimit-Reset") != "3" {
+		t.Errorf("unexpected rate limit headers: %v", header)
+	}
+	if server.count() != 3 {
+		t.Errorf("expected the limited request not to reach the backend, got %d requests", server.count())
+	}
+	if recorder := send("/api", "second"); recorder.Code != http.StatusOK {
+		t.Errorf("expected another API key to have its own limit, got %d", recorder.Code)
+	}
+	if recorder := send("/", "first"); recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "1000" {
+		t.Errorf("expected the requests that match no route to have the default limit, got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestInvalidRateLimits(t *testing.T) {
+	for _, limit := range []RateLimitConfig{
+		{},
+		{Rate: 1, Burst: -1},
+		{Rate: 1, Key: RateLimitByHeader},
+		{Rate: 1, Key: "user"},
+	} {
+		limit := limit
+		router, err := NewRouter(context.Background(), Config{URLs: []string{"http://127.0.0.1:1"}, RateLimit: &limit})
+		if err == nil {
+			router.Close()
+			t.Errorf("expected an error for %+v", limit)
+		}
+	}
+	router, err := NewRouter(context.Background(), Config{
+		URLs:           []string{"http://127.0.0.1:1"},
+		RateLimit:      &RateLimitConfig{Rate: 1},
+		TrustedProxies: []string{"proxy"},
+	})
+	if err == nil {
+		router.Close()
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+}
@@ -0,0 +1,125 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RewriteMiddleware is the name of the middleware that rewrites the paths of
+// the requests before they are sent to the backends. It is enabled, before
+// the listed middlewares, when there are rewrite rules.
+const RewriteMiddleware = "rewrite"
+
+// RewriteRule replaces the parts of the path that match the regex Match with
+// Replace, which can reference the capture groups as $1 or ${name}. Only the
+// first rule that matches is applied.
+type RewriteRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// RedirectRule answers the requests whose host matches Host and whose path
+// matches the regex Match with a redirect to To, without reaching a backend.
+// To can reference the capture groups of Match as $1 or ${name}. The query of
+// the request is kept if To has none.
+type RedirectRule struct {
+	// the host of the request, like the one of RouteConfig. Every host matches
+	// if it is empty.
+	Host string `yaml:"host"`
+	// every path matches if it is empty, $0 is then the whole path.
+	Match string `yaml:"match"`
+	To    string `yaml:"to"`
+	// 301, 302, 307 or 308, 301 if it is not set.
+	Status int `yaml:"status"`
+}
+
+type rewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func compileRewrites(rules []RewriteRule) ([]rewrite, error) {
+	rewrites := make([]rewrite, 0, len(rules))
+	for _, rule := range rules {
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("the rewrite %s is invalid: %s", rule.Match, err))
+		}
+		rewrites = append(rewrites, rewrite{match: match, replace: rule.Replace})
+	}
+	return rewrites, nil
+}
+
+func newRewrite(balancer Balancer, config Config, options map[string]interface{}) (*Middleware, error) {
+	rewrites, err := compileRewrites(config.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+	return &Middleware{
+		Name: RewriteMiddleware,
+		Handler: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				for _, r := range rewrites {
+					if r.match.MatchString(req.URL.Path) {
+						req = req.Clone(req.Context())
+						req.URL.Path = r.match.ReplaceAllString(req.URL.Path, r.replace)
+						req.URL.RawPath = ""
+						break
+					}
+				}
+				next.ServeHTTP(w, req)
+			})
+		},
+	}, nil
+}
+
+type redirect struct {
+	host   string
+	match  *regexp.Regexp
+	to     string
+	status int
+}
+
+func compileRedirects(rules []RedirectRule) ([]redirect, error) {
+	redirects := make([]redirect, 0, len(rules))
+	for _, rule := range rules {
+		pattern := rule.Match
+		if pattern == "" {
+			pattern = "^.*$"
+		}
+		match, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("the redirect %s is invalid: %s", rule.Match, err))
+		}
+		status := rule.Status
+		switch status {
+		case 0:
+			status = http.StatusMovedPermanently
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, errors.New(fmt.Sprintf("the status of the redirect %s must be 301, 302, 307 or 308, not %d", rule.Match, status))
+		}
+		redirects = append(redirects, redirect{host: rule.Host, match: match, to: rule.To, status: status})
+	}
+	return redirects, nil
+}
+
+// location returns where the request is redirected to, if it matches the
+// redirect.
+func (r redirect) location(req *http.Request) (string, bool) {
+	if r.host != "" && !matchHost(r.host, req.Host) {
+		return "", false
+	}
+	submatches := r.match.FindStringSubmatchIndex(req.URL.Path)
+	if submatches == nil {
+		return "", false
+	}
+	location := string(r.match.ExpandString(nil, r.to, req.URL.Path, submatches))
+	if req.URL.RawQuery != "" && !strings.Contains(location, "?") {
+		location += "?" + req.URL.RawQuery
+	}
+	return location, true
+}
@@ -0,0 +1,109 @@
+package balancer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newPathEchoServer answers every request with its path and query.
+func newPathEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.RequestURI()))
+	}))
+}
+
+// noRedirectClient returns the redirects instead of following them.
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func TestRewrites(t *testing.T) {
+	server := newPathEchoServer()
+	defer server.Close()
+	config := Config{
+		URLs: []string{server.URL + "/base"},
+		Rewrites: []RewriteRule{
+			{Match: `^/old/(\w+)`, Replace: "/new/$1"},
+			{Match: `^/old`, Replace: "/never"},
+		},
+		Routes: []RouteConfig{{
+			Name:       "users",
+			PathPrefix: "/users",
+			Rewrites:   []RewriteRule{{Match: `^/users/(?P<id>\d+)$`, Replace: "/api/v2/users/${id}"}},
+		}},
+	}
+	_, proxy := newTestRouter(t, config)
+
+	tests := map[string]string{
+		"/old/page/edit?a=1": "/base/new/page/edit?a=1",
+		"/old":               "/base/never",
+		"/users/42":          "/base/api/v2/users/42",
+		"/users/me":          "/base/users/me",
+		"/other":             "/base/other",
+	}
+	for path, expected := range tests {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("%s: expected the backend to receive %s, got %s", path, expected, body)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	servers, urls := newCountingServers(1)
+	defer closeServers(servers)
+	config := Config{
+		URLs: urls,
+		Redirects: []RedirectRule{
+			{Host: "old.example.com", To: "https://new.example.com$0"},
+			{Match: `^/blog/(\d+)/(.*)$`, To: "/posts/$2", Status: http.StatusFound},
+			{Match: `^/tmp$`, To: "/temporary?from=tmp", Status: http.StatusTemporaryRedirect},
+		},
+	}
+	_, proxy := newTestRouter(t, config)
+
+	tests := []struct {
+		host     string
+		path     string
+		status   int
+		location string
+	}{
+		{"old.example.com", "/a/b?x=1", http.StatusMovedPermanently, "https://new.example.com/a/b?x=1"},
+		{"", "/blog/2020/hello", http.StatusFound, "/posts/hello"},
+		{"", "/tmp?x=1", http.StatusTemporaryRedirect, "/temporary?from=tmp"},
+		{"", "/blog", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+test.path, nil)
+		req.Host = test.host
+		req.Header.Set("X-Test", "1")
+		resp, err := noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location {
+			t.Errorf("%s%s: expected %d to %q, got %d to %q", test.host, test.path, test.status, test.location, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+	if servers[0].count() != 1 {
+		t.Errorf("expected only the request that was not redirected to reach the backend, got %d", servers[0].count())
+	}
+}
+
+func TestInvalidRedirect(t *testing.T) {
+	config := Config{Redirects: []RedirectRule{{Match: "^/a", To: "/b", Status: http.StatusOK}}}
+	if _, err := NewRouter(context.Background(), config); err == nil {
+		t.Error("expected an error for a redirect with a 200 status")
+	}
+}
@@ -1,187 +1,117 @@
 package balancer
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
-	"time"
+	"sync"
 
 	"github.com/alidn/Yalp/backend"
-
-	"github.com/google/uuid"
 )
 
-const SessionPersistenceCookieName string = "LoadBalancerSessionCookie"
-
 // RoundRobinBalancer is a load balancer that uses the Round-Robin approach
-// to distribute requests across a group of servers.
+// to distribute requests across a group of servers. Each server receives as
+// many requests in a row as its weight.
 type RoundRobinBalancer struct {
-	backendPool   backend.Pool
+	managedPool
+	// guards curBackendIdx and served, which are advanced by concurrent
+	// requests.
+	indexMu       sync.Mutex
 	curBackendIdx int
-	Config        Config
+	// the number of requests in a row sent to the current backend.
+	served int
+	Config Config
 }
 
 // NewRoundRobinBalancer constructs and returns a RoundRobinBalancer with
 // no backends.
-func NewRoundRobinBalancer() *RoundRobinBalancer {
-	backendPool := backend.NewBackendPool()
+func NewRoundRobinBalancer(ctx context.Context) *RoundRobinBalancer {
 	return &RoundRobinBalancer{
-		backendPool:   *backendPool,
+		managedPool:   newManagedPool(ctx, backend.NewBackendPool()),
 		curBackendIdx: 0,
 	}
 }
 
 // NewRoundRobinBalancerWithURLs constructs and returns a RoundRobinBalancer
-// for the given list of urls.
-func NewRoundRobinBalancerWithURLs(urls ...string) (*RoundRobinBalancer, error) {
-	backendPool, err := backend.NewBackendPoolFromURLs(urls...)
+// for the given list of urls. The health-checks of the backends run until ctx
+// is done or the balancer is closed.
+func NewRoundRobinBalancerWithURLs(ctx context.Context, urls ...string) (*RoundRobinBalancer, error) {
+	return NewRoundRobinBalancerWithBackends(ctx, Config{URLs: urls}.BackendOptions()...)
+}
+
+// NewRoundRobinBalancerWithBackends is like NewRoundRobinBalancerWithURLs,
+// but it also sets the weight, the zone and the tags of the backends.
+func NewRoundRobinBalancerWithBackends(ctx context.Context, options ...backend.Options) (*RoundRobinBalancer, error) {
+	backendPool, err := backend.NewBackendPoolFromOptions(ctx, options...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &RoundRobinBalancer{
-		backendPool:   *backendPool,
+		managedPool:   newManagedPool(ctx, backendPool),
 		curBackendIdx: -1,
 	}, nil
 }
 
-func checkSessionPersistenceCookie(req *http.Request) (uuid.UUID, bool, error) {
-	for _, cookie := range req.Cookies() {
-		if cookie.Name == SessionPersistenceCookieName {
-			id, err := uuid.Parse(cookie.Value)
-			if err != nil {
-				return uuid.UUID{}, true, err
-			}
-			return id, true, nil
-		}
-	}
-	return uuid.UUID{}, false, nil
-}
-
-func (r *RoundRobinBalancer) checkBackendSession(req *http.Request) (*backend.RoundRobinBackend, bool, error) {
-	id, foundCookie, err := checkSessionPersistenceCookie(req)
-	if err != nil {
-		return nil, false, err
-	}
-	if foundCookie {
-		nextBackend, err := r.backendPool.Get(id)
-		if err != nil {
-			return nil, false, err
-		}
-		return nextBackend, true, nil
-	}
-	return nil, false, nil
-}
-
 // NewReverseProxy returns a new ReverseProxy that routes URLs to one of the servers among
 // the load balancer servers.
-func (r *RoundRobinBalancer) NewReverseProxy() *httputil.ReverseProxy {
-	director := func(req *http.Request) {
-		var nextBackend *backend.RoundRobinBackend = nil
-		if r.Config.SessionPersistenceConfig.Enabled {
-			b, foundCookie, err := r.checkBackendSession(req)
-			if err != nil {
-				_ = fmt.Errorf("checking the session of thr request")
-				return
-			}
-			if foundCookie {
-				nextBackend = b
-			}
-		}
-		// no session found, start a new one
-		if nextBackend == nil {
-			var err error
-			nextBackend, err = r.NextBackend()
-			if err != nil {
-				log.Fatal("could not get the next nextBackend", err)
-				return
-			}
-			if r.Config.SessionPersistenceConfig.Enabled {
-				sessionPersistenceCookie := r.createCookie(nextBackend.Id)
-				req.AddCookie(&sessionPersistenceCookie)
-				c := http.Cookie{
-					Name:  "SessionExists",
-					Value: "false",
-				}
-				req.AddCookie(&c)
-			}
-		}
-
-		targetURL := nextBackend.URL
-		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
-		req.Host = targetURL.Host
-		req.URL.RawQuery = targetURL.RawQuery
-		req.URL.Path = targetURL.Path
-	}
-
-	return &httputil.ReverseProxy{
-		Director: director,
-		ModifyResponse: func(response *http.Response) error {
-			for _, cookie := range response.Request.Cookies() {
-				fmt.Printf("%s = %s\n", cookie.Name, cookie.Value)
-				if cookie.Name == "SessionExists" && cookie.Value == "true" {
-					return nil
-				}
-			}
-
-			for _, cookie := range response.Request.Cookies() {
-				if cookie.Name == SessionPersistenceCookieName {
-					expirationPeriod := time.Duration(r.Config.SessionPersistenceConfig.ExpirationPeriod) * time.Second
-					cookie.Expires = time.Now().Add(expirationPeriod)
-					response.Header.Add("Set-Cookie", cookie.String())
-					c := http.Cookie{
-						Name:  "SessionExists",
-						Value: "true",
-					}
-					c.Expires = time.Now().Add(expirationPeriod)
-					response.Header.Add("Set-Cookie", c.String())
-				}
-			}
-			return nil
-		},
+func (r *RoundRobinBalancer) NewReverseProxy() http.Handler {
+	proxy, err := NewProxy(r, r.Config, r.transport)
+	if err != nil {
+		log.Fatal("could not construct the proxy: ", err)
 	}
+	return proxy
 }
 
-func (r *RoundRobinBalancer) createCookie(id uuid.UUID) http.Cookie {
-	expirationPeriod := time.Duration(r.Config.SessionPersistenceConfig.ExpirationPeriod) * time.Second
-	cookie := http.Cookie{
-		Name:     SessionPersistenceCookieName,
-		Value:    id.String(),
-		Expires:  time.Now().Add(expirationPeriod),
-		SameSite: http.SameSiteNoneMode,
+// Pick returns the next available backend.
+func (r *RoundRobinBalancer) Pick(req *http.Request) (backend.Backend, func(Result), error) {
+	b, err := r.next(req)
+	if err != nil {
+		return nil, nil, err
 	}
-	return cookie
+	return b, func(Result) {}, nil
 }
 
 // NextBackend returns the next available server. If it reaches the end,
 // it starts from the first server, and if no server is alive, it returns
 // and error.
-func (r *RoundRobinBalancer) NextBackend() (*backend.RoundRobinBackend, error) {
-	if len(r.backendPool.Backends) == 0 {
+func (r *RoundRobinBalancer) NextBackend() (backend.Backend, error) {
+	return r.next(nil)
+}
+
+func (r *RoundRobinBalancer) next(req *http.Request) (backend.Backend, error) {
+	backends := r.backendPool.List()
+	if len(backends) == 0 {
 		return nil, errors.New("There is no backend")
 	}
 
-	i := (r.curBackendIdx + 1) % len(r.backendPool.Backends)
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
+	if r.curBackendIdx >= 0 && r.curBackendIdx < len(backends) {
+		current := backends[r.curBackendIdx]
+		if r.served < current.Weight() && available(req, current) {
+			r.served++
+			return current, nil
+		}
+	}
+	i := (r.curBackendIdx + 1) % len(backends)
 
-	for counter := 0; counter < len(r.backendPool.Backends); counter++ {
-		candidateBackend := r.backendPool.Backends[i]
+	for counter := 0; counter < len(backends); counter++ {
+		candidateBackend := backends[i]
 
-		if candidateBackend.IsAlive {
+		if available(req, candidateBackend) {
 			r.curBackendIdx = i
+			r.served = 1
 			return candidateBackend, nil
 		}
-		i = (i + 1) % len(r.backendPool.Backends)
+		i = (i + 1) % len(backends)
 	}
 	return nil, errors.New("none of the servers is alive")
 }
 
 func (r *RoundRobinBalancer) GetCurIndex() int {
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
 	return r.curBackendIdx
 }
-
-func (r *RoundRobinBalancer) AddBackend(backend *backend.RoundRobinBackend) {
-	r.backendPool.Backends = append(r.backendPool.Backends, backend)
-}
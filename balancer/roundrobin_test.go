@@ -1,12 +1,17 @@
 package balancer
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/alidn/Yalp/backend"
 )
 
 func CreateTestServer(id int, logs *[]int) *httptest.Server {
@@ -24,12 +29,13 @@ func AssertInRange(t *testing.T, actual int, lowerbound int, upperbound int, mes
 	}
 }
 
-func GetClient(config Config, urls ...string) *httptest.Server {
-	loadBalancer, err := NewRoundRobinBalancerWithURLs(urls...)
+func GetClient(t *testing.T, config Config, urls ...string) *httptest.Server {
+	loadBalancer, err := NewRoundRobinBalancerWithURLs(context.Background(), urls...)
 
 	if err != nil {
 		log.Fatal("Could not get the load balancer", err)
 	}
+	t.Cleanup(loadBalancer.Close)
 
 	loadBalancer.Config = config
 
@@ -70,7 +76,7 @@ func TestOneServer(t *testing.T) {
 			ExpirationPeriod: 0,
 		},
 	}
-	client := GetClient(config, testServer.URL)
+	client := GetClient(t, config, testServer.URL)
 	defer client.Close()
 
 	MakeRequests(1000, client.URL)
@@ -95,7 +101,7 @@ func TestOneServerHighVolume(t *testing.T) {
 			ExpirationPeriod: 0,
 		},
 	}
-	client := GetClient(config, testServer.URL)
+	client := GetClient(t, config, testServer.URL)
 	defer client.Close()
 
 	MakeRequests(10000, client.URL)
@@ -122,7 +128,7 @@ func TestTwoServersNoSession(t *testing.T) {
 		},
 	}
 
-	client := GetClient(config, testServer1.URL, testServer2.URL)
+	client := GetClient(t, config, testServer1.URL, testServer2.URL)
 	defer client.Close()
 
 	MakeRequests(1000, client.URL)
@@ -149,7 +155,7 @@ func TestTwoServersNoSessionHighVolume(t *testing.T) {
 		},
 	}
 
-	client := GetClient(config, testServer1.URL, testServer2.URL)
+	client := GetClient(t, config, testServer1.URL, testServer2.URL)
 	defer client.Close()
 
 	MakeRequests(10000, client.URL)
@@ -176,7 +182,7 @@ func TestTwoServersWithSessionPersistence(t *testing.T) {
 		},
 	}
 
-	client := GetClient(config, testServer1.URL, testServer2.URL)
+	client := GetClient(t, config, testServer1.URL, testServer2.URL)
 	defer client.Close()
 
 	MakeRequests(100, client.URL)
@@ -199,11 +205,18 @@ func TestTwoServersWithSessionPersistence2(t *testing.T) {
 		Algorithm: "round-robin",
 		SessionPersistenceConfig: SessionPersistenceConfig{
 			Enabled:          true,
-			ExpirationPeriod: 3,
+			ExpirationPeriod: 60,
 		},
 	}
+	// the session expires when the clock of the sessions moves forward, not
+	// after 3000 requests took some time.
+	var offset int64
+	sessionClock = func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+	}
+	defer func() { sessionClock = time.Now }()
 
-	client := GetClient(config, testServer1.URL, testServer2.URL)
+	client := GetClient(t, config, testServer1.URL, testServer2.URL)
 	defer client.Close()
 
 	jar, err := cookiejar.New(nil)
@@ -214,7 +227,7 @@ func TestTwoServersWithSessionPersistence2(t *testing.T) {
 	for i := 0; i < 3000; i++ {
 		c.Get(client.URL)
 	}
-	time.Sleep(time.Second * 3)
+	atomic.StoreInt64(&offset, int64(time.Minute))
 	for i := 0; i < 1000; i++ {
 		c.Get(client.URL)
 	}
@@ -242,7 +255,7 @@ func TestThreeServersNoSession(t *testing.T) {
 		},
 	}
 
-	client := GetClient(config, testServer1.URL, testServer2.URL, testServer3.URL)
+	client := GetClient(t, config, testServer1.URL, testServer2.URL, testServer3.URL)
 	defer client.Close()
 
 	MakeRequests(1000, client.URL)
@@ -272,7 +285,7 @@ func TestThreeServersNoSessionHighVolume(t *testing.T) {
 		},
 	}
 
-	client := GetClient(config, testServer1.URL, testServer2.URL, testServer3.URL)
+	client := GetClient(t, config, testServer1.URL, testServer2.URL, testServer3.URL)
 	defer client.Close()
 
 	MakeRequests(10000, client.URL)
@@ -287,3 +300,165 @@ func TestThreeServersNoSessionHighVolume(t *testing.T) {
 	AssertInRange(t, secondServerN, 3300, 3360, "expected the server 2 to receive ~500 requests")
 	AssertInRange(t, thirdServerN, 3000, 3360, "expected the server 3 to receive ~500 requests")
 }
+
+// createProxiedOnlyTestServer is like CreateTestServer, but it ignores the
+// health-check requests, which do not carry the X-Test header.
+func createProxiedOnlyTestServer(id int, logs *[]int) *httptest.Server {
+	return newProxiedServer(func(w http.ResponseWriter, r *http.Request) {
+		*logs = append(*logs, id)
+	})
+}
+
+func makeTestRequests(count int, client *http.Client, url string) {
+	for i := 0; i < count; i++ {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-Test", "1")
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestDrainKeepsExistingSessions(t *testing.T) {
+	logs := make([]int, 0)
+	testServer1 := createProxiedOnlyTestServer(1, &logs)
+	testServer2 := createProxiedOnlyTestServer(2, &logs)
+
+	loadBalancer, err := NewRoundRobinBalancerWithURLs(context.Background(), testServer1.URL, testServer2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadBalancer.Close()
+	loadBalancer.Config = Config{
+		Algorithm: "round-robin",
+		SessionPersistenceConfig: SessionPersistenceConfig{
+			Enabled:          true,
+			ExpirationPeriod: 60,
+		},
+	}
+	client := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer client.Close()
+
+	jar, _ := cookiejar.New(nil)
+	existingSession := &http.Client{Jar: jar}
+	makeTestRequests(1, existingSession, client.URL)
+
+	first := loadBalancer.BackendStatuses()[0]
+	if first.Sessions != 1 {
+		t.Errorf("expected the first backend to have 1 session, found %d", first.Sessions)
+	}
+	if err := loadBalancer.SetBackendState(first.ID, backend.StateDraining); err != nil {
+		t.Fatal(err)
+	}
+
+	logs = logs[:0]
+	makeTestRequests(10, existingSession, client.URL)
+	for i := 0; i < 10; i++ {
+		jar, _ := cookiejar.New(nil)
+		makeTestRequests(1, &http.Client{Jar: jar}, client.URL)
+	}
+
+	AssertInRange(t, CountOccurrences(logs, 1), 10, 10, "expected the existing session to stay on the draining backend")
+	AssertInRange(t, CountOccurrences(logs, 2), 10, 10, "expected new sessions to go to the active backend")
+
+	if err := loadBalancer.SetBackendState(first.ID, backend.StateMaintenance); err != nil {
+		t.Fatal(err)
+	}
+	logs = logs[:0]
+	makeTestRequests(10, existingSession, client.URL)
+	AssertInRange(t, CountOccurrences(logs, 1), 0, 0, "expected the backend in maintenance to receive no requests")
+}
+
+func TestRemoveBackendWhileServing(t *testing.T) {
+	var served1, served2 int32
+	testServer1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served1, 1)
+	}))
+	testServer2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served2, 1)
+	}))
+
+	loadBalancer, err := NewRoundRobinBalancerWithURLs(context.Background(), testServer1.URL, testServer2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadBalancer.Close()
+	client := httptest.NewServer(loadBalancer.NewReverseProxy())
+	defer client.Close()
+
+	var failed int32
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				resp, err := http.Get(client.URL)
+				if err != nil || resp.StatusCode != http.StatusOK {
+					atomic.AddInt32(&failed, 1)
+					continue
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	second := loadBalancer.BackendStatuses()[1]
+	if err := loadBalancer.RemoveBackend(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		t.Errorf("expected every request to succeed, %d failed", failed)
+	}
+	before := atomic.LoadInt32(&served2)
+	MakeRequests(20, client.URL)
+	if atomic.LoadInt32(&served2) != before {
+		t.Errorf("expected the removed backend to receive no requests")
+	}
+	if len(loadBalancer.BackendStatuses()) != 1 {
+		t.Errorf("expected 1 backend after the removal")
+	}
+}
+
+func TestWeightedBackends(t *testing.T) {
+	servers, urls := newCountingServers(2)
+	defer closeServers(servers)
+	options := []backend.Options{{URL: urls[0], Weight: 3}, {URL: urls[1]}}
+
+	roundRobin, err := NewRoundRobinBalancerWithBackends(context.Background(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roundRobin.Close()
+	picked := map[string]int{}
+	for i := 0; i < 8; i++ {
+		b, err := roundRobin.NextBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[b.URL().String()]++
+	}
+	if picked[urls[0]] != 6 || picked[urls[1]] != 2 {
+		t.Errorf("expected round-robin to pick the backends 6 and 2 times, got %d and %d", picked[urls[0]], picked[urls[1]])
+	}
+
+	leastConnections, err := NewLeastConnectionBalancerWithBackends(context.Background(), Config{}, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leastConnections.Close()
+	picked = map[string]int{}
+	for i := 0; i < 8; i++ {
+		b, err := leastConnections.NextBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.AddInFlight(1)
+		picked[b.URL().String()]++
+	}
+	if picked[urls[0]] != 6 || picked[urls[1]] != 2 {
+		t.Errorf("expected least connections to pick the backends 6 and 2 times, got %d and %d", picked[urls[0]], picked[urls[1]])
+	}
+}
@@ -0,0 +1,502 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alidn/Yalp/backend"
+	"github.com/google/uuid"
+)
+
+// DefaultPool is the name of the pool made of the backends listed at the top
+// of the config. It serves the requests that match no route.
+const DefaultPool = "default"
+
+// PoolConfig is a named group of backends with its own algorithm, health-checks
+// and session persistence.
+type PoolConfig struct {
+	Name                     string                   `yaml:"name"`
+	Algorithm                Algorithm                `yaml:"algorithm"`
+	SessionPersistenceConfig SessionPersistenceConfig `yaml:"session_persistence"`
+	URLs                     []string                 `yaml:"backend_urls"`
+	Backends                 []backend.Options        `yaml:"backends"`
+	// the health-checks of the backends that do not configure their own.
+	HealthCheck backend.HealthCheckConfig `yaml:"health_check"`
+	// the circuit breaker of the backends that do not configure their own.
+	CircuitBreaker backend.CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// the header rules of every route to the pool.
+	HeaderRules HeaderRules `yaml:"header_rules"`
+	// the queue of the requests waiting for a backend below its max
+	// connections.
+	Queue QueueConfig `yaml:"queue"`
+}
+
+// BackendOptions returns the options of every backend of the pool, the ones
+// of URLs first.
+func (p PoolConfig) BackendOptions() []backend.Options {
+	options := make([]backend.Options, 0, len(p.URLs)+len(p.Backends))
+	for _, url := range p.URLs {
+		options = append(options, backend.Options{URL: url})
+	}
+	options = append(options, p.Backends...)
+	for i := range options {
+		healthCheck := &options[i].HealthCheck
+		if healthCheck.Path == "" {
+			healthCheck.Path = p.HealthCheck.Path
+		}
+		if healthCheck.Interval == 0 {
+			healthCheck.Interval = p.HealthCheck.Interval
+		}
+		if healthCheck.Timeout == 0 {
+			healthCheck.Timeout = p.HealthCheck.Timeout
+		}
+		if options[i].CircuitBreaker.Failures == 0 {
+			options[i].CircuitBreaker = p.CircuitBreaker
+		}
+	}
+	if p.SessionPersistenceConfig.StableIDs {
+		seen := make(map[string]int)
+		for i := range options {
+			options[i].ID = stableBackendID(p.Name, options[i].URL, seen[options[i].URL])
+			seen[options[i].URL]++
+		}
+	}
+	return options
+}
+
+// stableBackendID returns an id that only depends on the pool and the URL of
+// a backend, n tells apart the backends of a pool with the same URL.
+func stableBackendID(pool string, url string, n int) uuid.UUID {
+	name := pool + " " + url
+	if n > 0 {
+		name += " " + strconv.Itoa(n)
+	}
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(name))
+}
+
+// RouteConfig sends the requests that match every one of its conditions to
+// a pool. The conditions that are not set match every request.
+type RouteConfig struct {
+	Name string `yaml:"name"`
+	// the host of the request, without the port. "*.example.com" matches
+	// every subdomain of example.com.
+	Host       string `yaml:"host"`
+	PathPrefix string `yaml:"path_prefix"`
+	PathRegex  string `yaml:"path_regex"`
+	// the route matches any of the methods.
+	Methods []string `yaml:"methods"`
+	// the route matches if every header has the given value.
+	Headers map[string]string `yaml:"headers"`
+	// the routes with the highest priority are evaluated first, the ones with
+	// the same priority in the order of the config.
+	Priority int `yaml:"priority"`
+	// the pool the requests are sent to, the default pool if it is empty.
+	Pool string `yaml:"pool"`
+	// the middlewares of the route, the ones of the config if it is not set.
+	Middlewares []MiddlewareConfig `yaml:"middlewares"`
+	// the header rules of the route, applied after the ones of the pool.
+	HeaderRules HeaderRules `yaml:"header_rules"`
+	// the rewrites of the paths of the route.
+	Rewrites []RewriteRule `yaml:"rewrites"`
+	// sends a share of the requests of the route to another pool, the route
+	// must have a name.
+	Canary *CanaryConfig `yaml:"canary"`
+	// sends a copy of the requests of the route to a shadow pool.
+	Mirror *MirrorConfig `yaml:"mirror"`
+	// limits the rate of the requests of every client of the route.
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+}
+
+type route struct {
+	config    RouteConfig
+	pathRegex *regexp.Regexp
+	handler   http.Handler
+}
+
+type pool struct {
+	name     string
+	balancer Balancer
+	manager  *managedPool
+}
+
+// Router answers the requests that match a redirect, and sends the others to
+// the pool of the first route they match, or to the default pool if they
+// match none. It implements admin.Manager over the
+// backends of every pool, the backends added at runtime join the default
+// pool.
+type Router struct {
+	redirects []redirect
+	routes    []*route
+	// the default pool comes first.
+	pools []*pool
+	// the routes that split their traffic with a canary pool.
+	splits []*split
+	// the routes that mirror their traffic to a shadow pool.
+	mirrors  []*mirror
+	fallback http.Handler
+}
+
+// NewRouter constructs the pools and the routes of the config. The
+// health-checks of the backends run until ctx is done or the router is
+// closed.
+func NewRouter(ctx context.Context, config Config) (*Router, error) {
+	redirects, err := compileRedirects(config.Redirects)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{redirects: redirects}
+	poolConfigs := append([]PoolConfig{config.DefaultPool()}, config.Pools...)
+	pools := make(map[string]PoolConfig, len(poolConfigs))
+	for i, poolConfig := range poolConfigs {
+		if i > 0 && poolConfig.Name == DefaultPool {
+			r.Close()
+			return nil, errors.New(fmt.Sprintf("the pool name %s is reserved", DefaultPool))
+		}
+		if _, ok := pools[poolConfig.Name]; ok {
+			r.Close()
+			return nil, errors.New(fmt.Sprintf("the pool %s is defined twice", poolConfig.Name))
+		}
+		p, err := newPool(ctx, poolConfig, config)
+		if err != nil {
+			r.Close()
+			return nil, errors.New(fmt.Sprintf("could not construct the pool %s: %s", poolConfig.Name, err))
+		}
+		pools[poolConfig.Name] = poolConfig
+		r.pools = append(r.pools, p)
+	}
+
+	fallback, err := r.newRouteHandler(RouteConfig{
+		Name:      DefaultPool,
+		Pool:      DefaultPool,
+		Rewrites:  config.Rewrites,
+		Canary:    config.Canary,
+		Mirror:    config.Mirror,
+		RateLimit: config.RateLimit,
+	}, pools, config)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.fallback = fallback
+	for _, routeConfig := range config.Routes {
+		if routeConfig.Pool == "" {
+			routeConfig.Pool = DefaultPool
+		}
+		rt := &route{config: routeConfig}
+		if routeConfig.PathRegex != "" {
+			rt.pathRegex, err = regexp.Compile(routeConfig.PathRegex)
+			if err != nil {
+				r.Close()
+				return nil, errors.New(fmt.Sprintf("the path_regex of the route %s is invalid: %s", routeConfig.Name, err))
+			}
+		}
+		rt.handler, err = r.newRouteHandler(routeConfig, pools, config)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.routes = append(r.routes, rt)
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return r.routes[i].config.Priority > r.routes[j].config.Priority
+	})
+	return r, nil
+}
+
+func newPool(ctx context.Context, poolConfig PoolConfig, config Config) (*pool, error) {
+	poolBalancerConfig := config.poolConfig(poolConfig)
+	switch poolConfig.Algorithm {
+	case RoundRobin, "":
+		b, err := NewRoundRobinBalancerWithBackends(ctx, poolConfig.BackendOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		b.Config = poolBalancerConfig
+		return &pool{name: poolConfig.Name, balancer: b, manager: &b.managedPool}, nil
+	case LeastConnection:
+		b, err := NewLeastConnectionBalancerWithBackends(ctx, poolBalancerConfig, poolConfig.BackendOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		return &pool{name: poolConfig.Name, balancer: b, manager: &b.managedPool}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown algorithm: %s", poolConfig.Algorithm))
+}
+
+// newRouteHandler returns the handler of the route, which limits the rate
+// of the requests and mirrors them to the shadow pool of the route if it has
+// a rate limit and a mirror.
+func (r *Router) newRouteHandler(routeConfig RouteConfig, pools map[string]PoolConfig, config Config) (http.Handler, error) {
+	handler, err := r.newRouteTarget(routeConfig, pools, config)
+	if err != nil {
+		return nil, err
+	}
+	if routeConfig.Mirror != nil {
+		handler, err = r.newRouteMirror(routeConfig, pools, config, handler)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the requests over the limit are neither proxied nor mirrored.
+	if routeConfig.RateLimit != nil {
+		clientIP, err := config.clientIPs()
+		if err != nil {
+			return nil, err
+		}
+		limiter, err := newRateLimiter(routeConfig.Name, *routeConfig.RateLimit, clientIP, handler)
+		if err != nil {
+			return nil, err
+		}
+		return limiter, nil
+	}
+	return handler, nil
+}
+
+// newRouteMirror sends the requests of the route to handler, and a copy of
+// them to its mirror pool.
+func (r *Router) newRouteMirror(routeConfig RouteConfig, pools map[string]PoolConfig, config Config, handler http.Handler) (http.Handler, error) {
+	shadowConfig, ok := pools[routeConfig.Mirror.Pool]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the route %s uses the unknown mirror pool %s", routeConfig.Name, routeConfig.Mirror.Pool))
+	}
+	// the copies only go through the rules of the shadow pool, they do not
+	// start sessions.
+	shadowConfig.SessionPersistenceConfig.Enabled = false
+	shadow, err := r.newProxy(RouteConfig{Name: routeConfig.Name, Middlewares: []MiddlewareConfig{}}, shadowConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMirror(routeConfig.Name, *routeConfig.Mirror, r.pool(shadowConfig.Name), shadow, handler)
+	if err != nil {
+		return nil, err
+	}
+	r.mirrors = append(r.mirrors, m)
+	return m, nil
+}
+
+// newRouteTarget returns the proxy of the pool of the route, or a split
+// between its pool and its canary pool.
+func (r *Router) newRouteTarget(routeConfig RouteConfig, pools map[string]PoolConfig, config Config) (http.Handler, error) {
+	poolConfig, ok := pools[routeConfig.Pool]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the route %s uses the unknown pool %s", routeConfig.Name, routeConfig.Pool))
+	}
+	canary := routeConfig.Canary
+	if canary == nil {
+		return r.newProxy(routeConfig, poolConfig, config)
+	}
+
+	if routeConfig.Name == "" {
+		return nil, errors.New("a route with a canary must have a name")
+	}
+	for _, s := range r.splits {
+		if s.route == routeConfig.Name {
+			return nil, errors.New(fmt.Sprintf("the route %s is defined twice", routeConfig.Name))
+		}
+	}
+	canaryConfig, ok := pools[canary.Pool]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the route %s uses the unknown canary pool %s", routeConfig.Name, canary.Pool))
+	}
+	if canary.Sticky {
+		for _, p := range []PoolConfig{poolConfig, canaryConfig} {
+			if affinity := p.SessionPersistenceConfig.Affinity; affinity != "" && affinity != AffinityCookie {
+				return nil, errors.New(fmt.Sprintf("the sticky canary of the route %s requires the cookie affinity on the pool %s", routeConfig.Name, p.Name))
+			}
+		}
+		poolConfig.SessionPersistenceConfig.Enabled = true
+		canaryConfig.SessionPersistenceConfig.Enabled = true
+	}
+	primary, err := r.newProxy(routeConfig, poolConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := r.newProxy(routeConfig, canaryConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	// the cookies of both pools are accepted, whichever served the first
+	// request.
+	var keys []string
+	keys = append(keys, config.poolConfig(poolConfig).SessionPersistenceConfig.Keys...)
+	keys = append(keys, config.poolConfig(canaryConfig).SessionPersistenceConfig.Keys...)
+	sessions, err := newSessionSigner(keys)
+	if err != nil {
+		return nil, err
+	}
+	cookies := []string{poolConfig.SessionPersistenceConfig.SessionCookie.withDefaults().Name}
+	if name := canaryConfig.SessionPersistenceConfig.SessionCookie.withDefaults().Name; name != cookies[0] {
+		cookies = append(cookies, name)
+	}
+	s, err := newSplit(routeConfig.Name, *canary, sessions, cookies,
+		&variant{name: "primary", pool: r.pool(poolConfig.Name), handler: primary},
+		&variant{name: "canary", pool: r.pool(canaryConfig.Name), handler: secondary})
+	if err != nil {
+		return nil, err
+	}
+	r.splits = append(r.splits, s)
+	return s, nil
+}
+
+// newProxy returns the proxy of the route to the pool, with the middlewares
+// of the route and the settings of the pool.
+func (r *Router) newProxy(routeConfig RouteConfig, poolConfig PoolConfig, config Config) (http.Handler, error) {
+	p := r.pool(poolConfig.Name)
+	proxyConfig := config.poolConfig(poolConfig)
+	if routeConfig.Middlewares != nil {
+		proxyConfig.Middlewares = routeConfig.Middlewares
+	}
+	proxyConfig.HeaderRules = proxyConfig.HeaderRules.append(routeConfig.HeaderRules)
+	proxyConfig.Rewrites = routeConfig.Rewrites
+	handler, err := NewProxy(p.balancer, proxyConfig, p.manager.transport)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not construct the route %s: %s", routeConfig.Name, err))
+	}
+	return handler, nil
+}
+
+func (r *Router) pool(name string) *pool {
+	for _, p := range r.pools {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Pool returns the balancer of the pool with the given name.
+func (r *Router) Pool(name string) (Balancer, bool) {
+	p := r.pool(name)
+	if p == nil {
+		return nil, false
+	}
+	return p.balancer, true
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, rd := range r.redirects {
+		if location, ok := rd.location(req); ok {
+			http.Redirect(w, req, location, rd.status)
+			return
+		}
+	}
+	for _, rt := range r.routes {
+		if rt.matches(req) {
+			rt.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+	r.fallback.ServeHTTP(w, req)
+}
+
+func (rt *route) matches(req *http.Request) bool {
+	if rt.config.Host != "" && !matchHost(rt.config.Host, req.Host) {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, rt.config.PathPrefix) {
+		return false
+	}
+	if rt.pathRegex != nil && !rt.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(rt.config.Methods) > 0 {
+		found := false
+		for _, method := range rt.config.Methods {
+			if strings.EqualFold(method, req.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range rt.config.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost reports whether the host of a request matches pattern, which may
+// start with a "*." wildcard.
+func matchHost(pattern string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// Close closes the backends of every pool.
+func (r *Router) Close() {
+	for _, p := range r.pools {
+		p.balancer.Close()
+	}
+}
+
+// BackendStatuses returns a snapshot of the state of the backends of every
+// pool, with the name of their pool.
+func (r *Router) BackendStatuses() []backend.Status {
+	statuses := make([]backend.Status, 0)
+	for _, p := range r.pools {
+		for _, status := range p.manager.BackendStatuses() {
+			status.Pool = p.name
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// NewBackend constructs a backend for the default pool.
+func (r *Router) NewBackend(options backend.Options) (backend.Backend, error) {
+	return r.pools[0].manager.NewBackend(options)
+}
+
+// AddBackend adds the backend to the default pool.
+func (r *Router) AddBackend(b backend.Backend) {
+	r.pools[0].manager.AddBackend(b)
+}
+
+// RemoveBackend removes the backend with the given id from its pool and
+// closes it.
+func (r *Router) RemoveBackend(id uuid.UUID) error {
+	p, err := r.poolOf(id)
+	if err != nil {
+		return err
+	}
+	return p.manager.RemoveBackend(id)
+}
+
+// SetBackendState changes the admin state of the backend with the given id.
+func (r *Router) SetBackendState(id uuid.UUID, state backend.AdminState) error {
+	p, err := r.poolOf(id)
+	if err != nil {
+		return err
+	}
+	return p.manager.SetBackendState(id, state)
+}
+
+func (r *Router) poolOf(id uuid.UUID) (*pool, error) {
+	var err error
+	for _, p := range r.pools {
+		if _, err = p.manager.Backend(id); err == nil {
+			return p, nil
+		}
+	}
+	return nil, err
+}
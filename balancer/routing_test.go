@@ -0,0 +1,155 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// routeRequest sends a request through the router and returns the index of
+// the server that received it, or -1.
+func routeRequest(t *testing.T, proxyURL string, servers []*countingServer, method string, host string, path string, header http.Header) int {
+	t.Helper()
+	before := make([]int, len(servers))
+	for i, s := range servers {
+		before[i] = s.count()
+	}
+	req, _ := http.NewRequest(method, proxyURL+path, nil)
+	req.Host = host
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Test", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for i, s := range servers {
+		if s.count() != before[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// newTestRouter returns a router for config and a server that proxies through
+// it, both are closed when the test ends.
+func newTestRouter(t *testing.T, config Config) (*Router, *httptest.Server) {
+	t.Helper()
+	router, err := NewRouter(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.Close)
+	proxy := httptest.NewServer(router)
+	t.Cleanup(proxy.Close)
+	return router, proxy
+}
+
+func TestRoutes(t *testing.T) {
+	servers, urls := newCountingServers(4)
+	defer closeServers(servers)
+	config := Config{
+		URLs: urls[:1],
+		Pools: []PoolConfig{
+			{Name: "api", Algorithm: LeastConnection, URLs: urls[1:2]},
+			{Name: "static", URLs: urls[2:3]},
+			{Name: "admin", URLs: urls[3:4]},
+		},
+		Routes: []RouteConfig{
+			{Name: "api", Host: "*.example.com", PathPrefix: "/api", Pool: "api"},
+			{Name: "static", PathRegex: `\.(css|js)$`, Methods: []string{"GET"}, Pool: "static"},
+			{Name: "admin", Host: "example.com", Headers: map[string]string{"X-Admin": "1"}, Pool: "admin"},
+		},
+	}
+	_, proxy := newTestRouter(t, config)
+
+	tests := []struct {
+		method   string
+		host     string
+		path     string
+		header   http.Header
+		expected int
+	}{
+		{http.MethodGet, "api.example.com", "/api/users", nil, 1},
+		{http.MethodGet, "v2.api.example.com:9000", "/api", nil, 1},
+		{http.MethodGet, "example.com", "/api/users", nil, 0},
+		{http.MethodGet, "api.example.com", "/users", nil, 0},
+		{http.MethodGet, "example.com", "/app.js", nil, 2},
+		{http.MethodPost, "example.com", "/app.js", nil, 0},
+		{http.MethodGet, "example.com", "/", http.Header{"X-Admin": {"1"}}, 3},
+		{http.MethodGet, "example.com", "/", http.Header{"X-Admin": {"0"}}, 0},
+		{http.MethodGet, "other.com", "/", http.Header{"X-Admin": {"1"}}, 0},
+	}
+	for _, test := range tests {
+		got := routeRequest(t, proxy.URL, servers, test.method, test.host, test.path, test.header)
+		if got != test.expected {
+			t.Errorf("%s %s%s: expected the server %d, got %d", test.method, test.host, test.path, test.expected, got)
+		}
+	}
+}
+
+func TestRoutePriority(t *testing.T) {
+	servers, urls := newCountingServers(3)
+	defer closeServers(servers)
+	config := Config{
+		URLs: urls[:1],
+		Pools: []PoolConfig{
+			{Name: "first", URLs: urls[1:2]},
+			{Name: "second", URLs: urls[2:3]},
+		},
+		Routes: []RouteConfig{
+			{Name: "catch-all", Pool: "first"},
+			{Name: "api", PathPrefix: "/api", Pool: "second", Priority: 10},
+			{Name: "shadowed", PathPrefix: "/api", Pool: DefaultPool, Priority: 10},
+		},
+	}
+	_, proxy := newTestRouter(t, config)
+
+	if got := routeRequest(t, proxy.URL, servers, http.MethodGet, "", "/api", nil); got != 2 {
+		t.Errorf("expected the route with the highest priority to match first, got the server %d", got)
+	}
+	if got := routeRequest(t, proxy.URL, servers, http.MethodGet, "", "/", nil); got != 1 {
+		t.Errorf("expected the catch-all route to match, got the server %d", got)
+	}
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	configs := map[string]Config{
+		"unknown pool":      {Routes: []RouteConfig{{Name: "api", Pool: "api"}}},
+		"reserved name":     {Pools: []PoolConfig{{Name: DefaultPool}}},
+		"duplicate pool":    {Pools: []PoolConfig{{Name: "api"}, {Name: "api"}}},
+		"invalid regex":     {Routes: []RouteConfig{{Name: "api", PathRegex: "("}}},
+		"unknown algorithm": {Pools: []PoolConfig{{Name: "api", Algorithm: "random"}}},
+	}
+	for name, config := range configs {
+		router, err := NewRouter(context.Background(), config)
+		if err == nil {
+			router.Close()
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBackendStatusesNamePools(t *testing.T) {
+	servers, urls := newCountingServers(3)
+	defer closeServers(servers)
+	router, err := NewRouter(context.Background(), Config{
+		URLs:  urls[:1],
+		Pools: []PoolConfig{{Name: "api", URLs: urls[1:]}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	pools := map[string]string{}
+	for _, status := range router.BackendStatuses() {
+		pools[status.URL] = status.Pool
+	}
+	if pools[urls[0]] != DefaultPool || pools[urls[1]] != "api" || pools[urls[2]] != "api" {
+		t.Errorf("expected the backends to name their pool, got %v", pools)
+	}
+}
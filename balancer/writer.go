@@ -0,0 +1,25 @@
+package balancer
+
+import "net/http"
+
+// discardWriter records the status of a response and discards its body.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func newDiscardWriter() *discardWriter {
+	return &discardWriter{header: make(http.Header), status: http.StatusOK}
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	w.status = status
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alidn/Yalp/admin"
+)
+
+// client talks to the admin API of a running Yalp.
+type client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func newClient(address string, token string) *client {
+	network, addr := admin.SplitAddress(address)
+	transport := &http.Transport{}
+	baseURL := "http://" + addr
+	if network == "unix" {
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", addr)
+		}
+		// the host is ignored when dialing the socket.
+		baseURL = "http://yalp"
+	}
+	return &client{
+		baseURL: baseURL,
+		token:   token,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+	}
+}
+
+// do sends a request to the admin API and returns the response body. It
+// returns an error if the response status is not 2xx.
+func (c *client) do(method string, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiError := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(content, &apiError) == nil && apiError.Error != "" {
+			return nil, errors.New(fmt.Sprintf("%s: %s", resp.Status, apiError.Error))
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return content, nil
+}
+
+// getJSON sends a request and decodes the JSON response into out.
+func (c *client) getJSON(method string, path string, body interface{}, out interface{}) error {
+	content, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, out)
+}
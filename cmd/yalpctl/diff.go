@@ -0,0 +1,62 @@
+package main
+
+import "strings"
+
+// diffLines returns a line-based diff that turns a into b. Every line is
+// prefixed with "  " if it is in both, "- " if it is only in a, and "+ " if
+// it is only in b.
+func diffLines(a string, b string) []string {
+	x := strings.Split(strings.TrimRight(a, "\n"), "\n")
+	y := strings.Split(strings.TrimRight(b, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := make([]string, 0, len(x)+len(y))
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			diff = append(diff, "  "+x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+x[i])
+			i++
+		default:
+			diff = append(diff, "+ "+y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		diff = append(diff, "- "+x[i])
+	}
+	for ; j < len(y); j++ {
+		diff = append(diff, "+ "+y[j])
+	}
+	return diff
+}
+
+// hasChanges reports whether the diff contains any added or removed line.
+func hasChanges(diff []string) bool {
+	for _, line := range diff {
+		if !strings.HasPrefix(line, "  ") {
+			return true
+		}
+	}
+	return false
+}
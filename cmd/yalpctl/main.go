@@ -0,0 +1,320 @@
+// Command yalpctl controls a running Yalp through its admin API.
+//
+//	yalpctl [flags] backends list
+//	yalpctl [flags] backends get <id>
+//	yalpctl [flags] backends add <url> [weight]
+//	yalpctl [flags] backends remove <id>
+//	yalpctl [flags] backends drain <id>
+//	yalpctl [flags] backends maintenance <id>
+//	yalpctl [flags] backends activate <id>
+//	yalpctl [flags] canaries list
+//	yalpctl [flags] canaries set <route> <percent>
+//	yalpctl [flags] health
+//	yalpctl [flags] config diff [file]
+//
+// The admin address and token default to the YALP_ADMIN_ADDRESS and
+// YALP_ADMIN_TOKEN environment variables.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/alidn/Yalp/admin"
+	"github.com/alidn/Yalp/backend"
+	"github.com/alidn/Yalp/balancer"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultAddress = "127.0.0.1:9001"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// command is the parsed command line.
+type command struct {
+	client *client
+	output string
+	args   []string
+	stdout io.Writer
+}
+
+// run executes the command line and returns the exit code.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("yalpctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	address := flags.String("addr", envOr("YALP_ADMIN_ADDRESS", defaultAddress),
+		`the admin address, e.g. 127.0.0.1:9001 or unix:/var/run/yalp.sock`)
+	token := flags.String("token", os.Getenv(admin.TokenEnv), "the admin token")
+	output := flags.String("o", "table", "the output format, table or json")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: yalpctl [flags] backends list|get|add|remove|drain|maintenance|activate")
+		fmt.Fprintln(stderr, "       yalpctl [flags] canaries list|set")
+		fmt.Fprintln(stderr, "       yalpctl [flags] health")
+		fmt.Fprintln(stderr, "       yalpctl [flags] config diff [file]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "unknown output format: %s\n", *output)
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cmd := &command{
+		client: newClient(*address, *token),
+		output: *output,
+		args:   flags.Args(),
+		stdout: stdout,
+	}
+	code, err := cmd.execute()
+	if err == errUsage {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "yalpctl:", err)
+		return 1
+	}
+	return code
+}
+
+var errUsage = errors.New("usage")
+
+func (c *command) execute() (int, error) {
+	switch c.args[0] {
+	case "backends":
+		return 0, c.backends()
+	case "canaries":
+		return 0, c.canaries()
+	case "health":
+		return c.health()
+	case "config":
+		if len(c.args) < 2 || c.args[1] != "diff" || len(c.args) > 3 {
+			return 0, errUsage
+		}
+		return c.configDiff()
+	}
+	return 0, errUsage
+}
+
+func (c *command) backends() error {
+	if len(c.args) < 2 {
+		return errUsage
+	}
+	action, operands := c.args[1], c.args[2:]
+
+	switch action {
+	case "list":
+		if len(operands) != 0 {
+			return errUsage
+		}
+		statuses := make([]backend.Status, 0)
+		if err := c.client.getJSON(http.MethodGet, "/api/backends", nil, &statuses); err != nil {
+			return err
+		}
+		return c.printBackends(statuses)
+	case "add":
+		if len(operands) < 1 || len(operands) > 2 {
+			return errUsage
+		}
+		body := map[string]interface{}{"url": operands[0]}
+		if len(operands) == 2 {
+			weight, err := strconv.Atoi(operands[1])
+			if err != nil {
+				return errors.New("the weight must be an integer")
+			}
+			body["weight"] = weight
+		}
+		status := backend.Status{}
+		if err := c.client.getJSON(http.MethodPost, "/api/backends", body, &status); err != nil {
+			return err
+		}
+		return c.printBackends([]backend.Status{status})
+	}
+
+	if len(operands) != 1 {
+		return errUsage
+	}
+	path := "/api/backends/" + operands[0]
+	status := backend.Status{}
+	switch action {
+	case "get":
+		if err := c.client.getJSON(http.MethodGet, path, nil, &status); err != nil {
+			return err
+		}
+	case "remove":
+		if _, err := c.client.do(http.MethodDelete, path, nil); err != nil {
+			return err
+		}
+		if c.output == "json" {
+			return c.printJSON(map[string]string{"removed": operands[0]})
+		}
+		fmt.Fprintf(c.stdout, "removed %s\n", operands[0])
+		return nil
+	case "drain", "maintenance", "activate":
+		if err := c.client.getJSON(http.MethodPost, path+"/"+action, nil, &status); err != nil {
+			return err
+		}
+	default:
+		return errUsage
+	}
+	return c.printBackends([]backend.Status{status})
+}
+
+func (c *command) canaries() error {
+	if len(c.args) < 2 {
+		return errUsage
+	}
+	action, operands := c.args[1], c.args[2:]
+
+	switch action {
+	case "list":
+		if len(operands) != 0 {
+			return errUsage
+		}
+		statuses := make([]admin.CanaryStatus, 0)
+		if err := c.client.getJSON(http.MethodGet, "/api/canaries", nil, &statuses); err != nil {
+			return err
+		}
+		return c.printCanaries(statuses)
+	case "set":
+		if len(operands) != 2 {
+			return errUsage
+		}
+		percent, err := strconv.ParseFloat(operands[1], 64)
+		if err != nil {
+			return errors.New("the percent must be a number")
+		}
+		status := admin.CanaryStatus{}
+		body := map[string]interface{}{"percent": percent}
+		if err := c.client.getJSON(http.MethodPost, "/api/canaries/"+operands[0], body, &status); err != nil {
+			return err
+		}
+		return c.printCanaries([]admin.CanaryStatus{status})
+	}
+	return errUsage
+}
+
+// health prints the health summary. The exit code is 1 if Yalp is unhealthy.
+func (c *command) health() (int, error) {
+	if len(c.args) != 1 {
+		return 0, errUsage
+	}
+	health := admin.Health{}
+	if err := c.client.getJSON(http.MethodGet, "/api/health", nil, &health); err != nil {
+		return 0, err
+	}
+	if c.output == "json" {
+		if err := c.printJSON(health); err != nil {
+			return 0, err
+		}
+	} else {
+		fmt.Fprintf(c.stdout, "%s (%d/%d backends alive)\n", health.Status, health.Alive, health.Total)
+	}
+	if health.Status == admin.Unhealthy {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// configDiff compares the running configuration with a configuration file.
+// Like diff, the exit code is 1 if they differ.
+func (c *command) configDiff() (int, error) {
+	filename := "config.yaml"
+	if len(c.args) == 3 {
+		filename = c.args[2]
+	}
+	fileConfig, err := balancer.ReadConfigFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	// marshaling the file through balancer.Config normalizes it the same way
+	// as the running configuration.
+	local, err := yaml.Marshal(fileConfig.Redacted())
+	if err != nil {
+		return 0, err
+	}
+	running, err := c.client.do(http.MethodGet, "/api/config", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	diff := diffLines(string(running), string(local))
+	changed := hasChanges(diff)
+	if c.output == "json" {
+		err = c.printJSON(struct {
+			Changed bool     `json:"changed"`
+			Diff    []string `json:"diff"`
+		}{changed, diff})
+	} else if changed {
+		fmt.Fprintln(c.stdout, "--- running")
+		fmt.Fprintln(c.stdout, "+++", filename)
+		for _, line := range diff {
+			fmt.Fprintln(c.stdout, line)
+		}
+	} else {
+		fmt.Fprintln(c.stdout, "the running configuration matches", filename)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if changed {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (c *command) printBackends(statuses []backend.Status) error {
+	if c.output == "json" {
+		return c.printJSON(statuses)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPOOL\tURL\tZONE\tALIVE\tSTATE\tWEIGHT\tCONNECTIONS\tSESSIONS\tLATENCY")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%d\t%d\t%d\t%.1fms\n",
+			s.ID, s.Pool, s.URL, s.Zone, s.Alive, s.State, s.Weight, s.OpenConnections, s.Sessions, s.Latency)
+	}
+	return w.Flush()
+}
+
+func (c *command) printCanaries(statuses []admin.CanaryStatus) error {
+	if c.output == "json" {
+		return c.printJSON(statuses)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUTE\tPERCENT\tSTICKY\tVARIANT\tPOOL\tREQUESTS\tOVERRIDDEN\tERROR RATE")
+	for _, s := range statuses {
+		for _, v := range s.Variants {
+			fmt.Fprintf(w, "%s\t%g%%\t%t\t%s\t%s\t%d\t%d\t%.2f%%\n",
+				s.Route, s.Percent, s.Sticky, v.Name, v.Pool, v.Requests, v.Overridden, 100*v.ErrorRate)
+		}
+	}
+	return w.Flush()
+}
+
+func (c *command) printJSON(value interface{}) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
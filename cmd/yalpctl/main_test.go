@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alidn/Yalp/admin"
+	"github.com/alidn/Yalp/balancer"
+)
+
+// startAdmin serves the admin API of a round-robin balancer on a Unix socket
+// and returns its address.
+func startAdmin(t *testing.T, config balancer.Config) (string, *balancer.RoundRobinBalancer) {
+	t.Helper()
+	loadBalancer, err := balancer.NewRoundRobinBalancerWithURLs(context.Background(), config.URLs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(loadBalancer.Close)
+	handler, err := admin.NewHandler(loadBalancer, "secret", func() interface{} {
+		return config.Redacted()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := "unix:" + filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := admin.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return address, loadBalancer
+}
+
+func runCommand(address string, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run(append([]string{"-addr", address, "-token", "secret"}, args...), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestBackendsCommands(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+	address, loadBalancer := startAdmin(t, balancer.Config{URLs: []string{testServer.URL}})
+
+	code, stdout, stderr := runCommand(address, "backends", "list")
+	if code != 0 || !strings.Contains(stdout, testServer.URL) || !strings.Contains(stdout, "active") {
+		t.Errorf("unexpected output of backends list (%d): %s %s", code, stdout, stderr)
+	}
+
+	id := loadBalancer.BackendStatuses()[0].ID.String()
+	code, stdout, _ = runCommand(address, "-o", "json", "backends", "drain", id)
+	if code != 0 || !strings.Contains(stdout, `"state": "draining"`) {
+		t.Errorf("unexpected output of backends drain (%d): %s", code, stdout)
+	}
+
+	code, stdout, _ = runCommand(address, "health")
+	if code != 0 || !strings.HasPrefix(stdout, "healthy") {
+		t.Errorf("unexpected output of health (%d): %s", code, stdout)
+	}
+
+	code, _, stderr = runCommand(address, "backends", "drain", "not-an-id")
+	if code != 1 || !strings.Contains(stderr, "404") {
+		t.Errorf("expected backends drain to fail for an unknown id (%d): %s", code, stderr)
+	}
+
+	code, _, stderr = runCommand(address, "-token", "wrong", "backends", "list")
+	if code != 1 || !strings.Contains(stderr, "401") {
+		t.Errorf("expected a wrong token to be rejected (%d): %s", code, stderr)
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	config := balancer.Config{
+		Algorithm: balancer.RoundRobin,
+		URLs:      []string{"http://127.0.0.1:1"},
+	}
+	address, _ := startAdmin(t, config)
+
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	content := "algorithm: round-robin\nbackend_urls:\n  - http://127.0.0.1:1\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, stdout, stderr := runCommand(address, "config", "diff", filename)
+	if code != 0 {
+		t.Errorf("expected no difference (%d): %s %s", code, stdout, stderr)
+	}
+
+	content = "algorithm: least-connection\nbackend_urls:\n  - http://127.0.0.1:1\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, stdout, _ = runCommand(address, "config", "diff", filename)
+	if code != 1 || !strings.Contains(stdout, "- algorithm: round-robin") ||
+		!strings.Contains(stdout, "+ algorithm: least-connection") {
+		t.Errorf("expected the algorithm to differ (%d): %s", code, stdout)
+	}
+}
+
+func TestCanariesCommands(t *testing.T) {
+	config := balancer.Config{
+		Pools:  []balancer.PoolConfig{{Name: "v2"}},
+		Routes: []balancer.RouteConfig{{Name: "app", Canary: &balancer.CanaryConfig{Pool: "v2", Percent: 5}}},
+	}
+	router, err := balancer.NewRouter(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	handler, err := admin.NewHandler(router, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	code, stdout, stderr := runCommand(address, "canaries", "set", "app", "12.5")
+	if code != 0 || !strings.Contains(stdout, "12.5%") || !strings.Contains(stdout, "v2") {
+		t.Errorf("unexpected output of canaries set (%d): %s %s", code, stdout, stderr)
+	}
+	code, stdout, _ = runCommand(address, "canaries", "list")
+	if code != 0 || !strings.Contains(stdout, "12.5%") {
+		t.Errorf("unexpected output of canaries list (%d): %s", code, stdout)
+	}
+}
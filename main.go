@@ -1,41 +1,153 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/alidn/Yalp/admin"
 	"github.com/alidn/Yalp/balancer"
+	"github.com/alidn/Yalp/server"
+	"github.com/alidn/Yalp/tracing"
 )
 
+// how long a new process started on SIGUSR2 may take to be ready.
+const upgradeTimeout = 30 * time.Second
+
 func main() {
 	config, err := balancer.ReadConfigFile("config.yaml")
 	if err != nil {
 		panic("Could not find the config file")
 	}
 
-	urls := config.URLs
-	var loadBalancer balancer.Balancer
-	if config.Algorithm == balancer.RoundRobin {
-		loadBalancer, err = balancer.NewRoundRobinBalancerWithURLs(urls...)
-		if err != nil {
-			log.Fatal("could not start the round-robin balancer: ", err)
-		}
-	} else if config.Algorithm == balancer.LeastConnection {
-		loadBalancer, err = balancer.NewRoundRobinBalancerWithURLs(urls...)
-		if err != nil {
-			log.Fatal("could not start the least-connection balancer: ", err)
-		}
+	tracing.SetTracer(tracing.NewTracer(config.Tracing))
+
+	ctx := context.Background()
+	router, err := balancer.NewRouter(ctx, config)
+	if err != nil {
+		log.Fatal("could not start the balancer: ", err)
 	}
 
-	reverseProxy := loadBalancer.NewReverseProxy()
-	println("Server listening on port 9000")
+	upgrader, err := server.NewUpgrader()
+	if err != nil {
+		log.Fatal("could not take over the listeners: ", err)
+	}
 
-	err = http.ListenAndServe(":9000", reverseProxy)
+	var adminServer *http.Server
+	if config.Admin.Enabled {
+		adminServer = startAdminServer(config, router, upgrader)
+	}
+
+	proxyServer := server.New(":9000", tracing.Handler(router), config.Shutdown)
+	listener, err := upgrader.Listen("proxy", func() (net.Listener, error) {
+		return net.Listen("tcp", ":9000")
+	})
 	if err != nil {
 		log.Fatal("ERROR, could not start the server", err)
 	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	serveErr := make(chan error, 1)
+	go func() {
+		println("Server listening on port 9000")
+		serveErr <- proxyServer.Serve(listener)
+	}()
+	if err := upgrader.Ready(); err != nil {
+		log.Fatal("could not tell the previous process that this one is ready: ", err)
+	}
+
+	upgraded := waitForShutdown(signals, serveErr, upgrader)
+	// a second signal skips the remaining drain.
+	shutdownCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-signals
+		log.Print("received a second signal, closing every connection")
+		cancel()
+	}()
+
+	var summary server.Summary
+	if upgraded {
+		// the new process accepts the connections, there is no need to wait
+		// for the pre-stop delay.
+		summary = proxyServer.Drain(shutdownCtx)
+	} else {
+		summary = proxyServer.Shutdown(shutdownCtx)
+	}
+	if adminServer != nil {
+		adminCtx, cancelAdmin := context.WithTimeout(ctx, time.Second)
+		_ = adminServer.Shutdown(adminCtx)
+		cancelAdmin()
+	}
+	router.Close()
+	tracerCtx, cancelTracer := context.WithTimeout(ctx, 5*time.Second)
+	if err := tracing.GetTracer().Shutdown(tracerCtx); err != nil {
+		log.Print("could not flush the traces: ", err)
+	}
+	cancelTracer()
+	cancel()
+	log.Print("shutdown complete: ", summary)
+}
+
+// waitForShutdown blocks until the process should stop and reports whether a
+// new process took over its listeners.
+func waitForShutdown(signals <-chan os.Signal, serveErr <-chan error, upgrader *server.Upgrader) bool {
+	for {
+		select {
+		case err := <-serveErr:
+			log.Fatal("ERROR, could not start the server", err)
+		case sig := <-signals:
+			if sig != syscall.SIGUSR2 {
+				log.Printf("received %s, shutting down", sig)
+				return false
+			}
+			log.Print("received SIGUSR2, starting a new process")
+			if err := upgrader.Upgrade(upgradeTimeout); err != nil {
+				log.Print("could not upgrade, still serving: ", err)
+				continue
+			}
+			log.Print("the new process is ready, draining the connections")
+			return true
+		}
+	}
+}
+
+// startAdminServer serves the admin API in the background and returns its
+// server so that it can be shut down.
+func startAdminServer(config balancer.Config, manager admin.Manager, upgrader *server.Upgrader) *http.Server {
+	runningConfig := func() interface{} {
+		return config.Redacted()
+	}
+	token := config.Admin.Token
+	if token == "" {
+		token = os.Getenv(admin.TokenEnv)
+	}
+	handler, err := admin.NewHandler(manager, token, runningConfig)
+	if err != nil {
+		log.Fatal("could not start the admin API: ", err)
+	}
+	listener, err := upgrader.Listen("admin", func() (net.Listener, error) {
+		return admin.Listen(config.Admin.Address)
+	})
+	if err != nil {
+		log.Fatal("could not start the admin API: ", err)
+	}
+	println("Admin API listening on", config.Admin.Address)
+	adminServer := &http.Server{Handler: handler}
+	go func() {
+		err := adminServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("ERROR, could not start the admin API", err)
+		}
+	}()
+	return adminServer
 }
 
 func example() {
@@ -61,7 +173,7 @@ func example() {
 	testServer2 := httptest.NewServer(http.HandlerFunc(handler2))
 	testServer3 := httptest.NewServer(http.HandlerFunc(handler3))
 
-	loadBalancer, err := balancer.NewRoundRobinBalancerWithURLs(testServer.URL,
+	loadBalancer, err := balancer.NewRoundRobinBalancerWithURLs(context.Background(), testServer.URL,
 		testServer2.URL, testServer3.URL)
 	if err != nil {
 		log.Fatal(err)
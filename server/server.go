@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the graceful shutdown settings.
+type Config struct {
+	// how long the readiness endpoint fails before the server stops
+	// accepting connections, in seconds. It gives the orchestrator time to
+	// stop sending new traffic.
+	PreStopDelay int `yaml:"pre_stop_delay"`
+	// how long in-flight requests and WebSocket tunnels may take to finish
+	// once the server stopped accepting connections, in seconds.
+	DrainTimeout int `yaml:"drain_timeout"`
+	// the path of the readiness endpoint. It is served by Yalp itself and
+	// never proxied.
+	ReadinessPath string `yaml:"readiness_path"`
+}
+
+const (
+	defaultDrainTimeout  = 30
+	defaultReadinessPath = "/-/ready"
+	drainPollInterval    = 50 * time.Millisecond
+)
+
+// Server is an http.Server that shuts down gracefully: it fails its readiness
+// endpoint first, then stops accepting connections and waits for the
+// in-flight requests, including hijacked connections such as WebSocket
+// tunnels, before closing them.
+type Server struct {
+	http   *http.Server
+	config Config
+
+	shuttingDown int32
+	inFlight     int64
+
+	// the hijacked connections that are still open.
+	tunnelsMu sync.Mutex
+	tunnels   map[net.Conn]struct{}
+}
+
+// Summary describes how a shutdown went.
+type Summary struct {
+	// whether every request and tunnel finished before the drain timeout.
+	Drained             bool
+	ForceClosedRequests int
+	ForceClosedTunnels  int
+	Duration            time.Duration
+}
+
+func (s Summary) String() string {
+	if s.Drained {
+		return fmt.Sprintf("every connection drained in %s", s.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("force-closed %d requests and %d WebSocket tunnels after %s",
+		s.ForceClosedRequests, s.ForceClosedTunnels, s.Duration.Round(time.Millisecond))
+}
+
+// New constructs a Server that serves handler on addr.
+func New(addr string, handler http.Handler, config Config) *Server {
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = defaultDrainTimeout
+	}
+	if config.ReadinessPath == "" {
+		config.ReadinessPath = defaultReadinessPath
+	}
+	s := &Server{
+		config:  config,
+		tunnels: make(map[net.Conn]struct{}),
+	}
+	s.http = &http.Server{
+		Addr:    addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { s.serveHTTP(handler, w, req) }),
+	}
+	return s
+}
+
+// ListenAndServe listens on the address of the server and serves requests
+// until Shutdown is called, it then returns http.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	return s.http.ListenAndServe()
+}
+
+// Serve serves requests on the listener until Shutdown is called, it then
+// returns http.ErrServerClosed.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.http.Serve(listener)
+}
+
+// Ready returns false once the shutdown started.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 0
+}
+
+func (s *Server) serveHTTP(next http.Handler, w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == s.config.ReadinessPath {
+		if s.Ready() {
+			_, _ = fmt.Fprintln(w, "ready")
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintln(w, "shutting down")
+		}
+		return
+	}
+
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	next.ServeHTTP(&trackingWriter{ResponseWriter: w, server: s}, req)
+}
+
+// Shutdown fails the readiness endpoint, waits for the pre-stop delay and then
+// drains the server.
+func (s *Server) Shutdown(ctx context.Context) Summary {
+	start := time.Now()
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	preStopDelay := time.Duration(s.config.PreStopDelay) * time.Second
+	if preStopDelay > 0 {
+		log.Printf("failing %s for %s before shutting down", s.config.ReadinessPath, preStopDelay)
+		select {
+		case <-time.After(preStopDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	summary := s.Drain(ctx)
+	summary.Duration = time.Since(start)
+	return summary
+}
+
+// Drain stops accepting connections and waits up to the drain timeout for the
+// in-flight requests and tunnels to finish, the ones still running after the
+// drain timeout, or when ctx is done, are closed. Unlike Shutdown it does not
+// wait for the pre-stop delay, it is used when another process took over the
+// listener.
+func (s *Server) Drain(ctx context.Context) Summary {
+	start := time.Now()
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	drainCtx, cancel := context.WithTimeout(ctx, time.Duration(s.config.DrainTimeout)*time.Second)
+	defer cancel()
+	// Shutdown closes the listeners and the idle connections and waits for
+	// the active ones, but it ignores the hijacked connections, which are
+	// counted as in-flight requests until their handler returns.
+	err := s.http.Shutdown(drainCtx)
+	if err == nil {
+		err = s.waitForInFlight(drainCtx)
+	}
+
+	summary := Summary{Drained: err == nil}
+	if err != nil {
+		// the handlers of the tunnels return once they are closed, so the
+		// requests are counted first.
+		inFlight := int(atomic.LoadInt64(&s.inFlight))
+		summary.ForceClosedTunnels = s.closeTunnels()
+		if inFlight > summary.ForceClosedTunnels {
+			summary.ForceClosedRequests = inFlight - summary.ForceClosedTunnels
+		}
+		_ = s.http.Close()
+	}
+	summary.Duration = time.Since(start)
+	return summary
+}
+
+func (s *Server) waitForInFlight(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.inFlight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// closeTunnels closes every hijacked connection and returns how many there
+// were.
+func (s *Server) closeTunnels() int {
+	s.tunnelsMu.Lock()
+	tunnels := make([]net.Conn, 0, len(s.tunnels))
+	for conn := range s.tunnels {
+		tunnels = append(tunnels, conn)
+	}
+	s.tunnelsMu.Unlock()
+
+	// closing a tracked connection removes it from the tunnels.
+	for _, conn := range tunnels {
+		_ = conn.Close()
+	}
+	return len(tunnels)
+}
+
+func (s *Server) addTunnel(conn net.Conn) {
+	s.tunnelsMu.Lock()
+	defer s.tunnelsMu.Unlock()
+	s.tunnels[conn] = struct{}{}
+}
+
+func (s *Server) removeTunnel(conn net.Conn) {
+	s.tunnelsMu.Lock()
+	defer s.tunnelsMu.Unlock()
+	delete(s.tunnels, conn)
+}
+
+// trackingWriter registers the connections hijacked by the handler, so that
+// they can be closed if they outlive the drain timeout.
+type trackingWriter struct {
+	http.ResponseWriter
+	server *Server
+}
+
+func (w *trackingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tracked := &trackedConn{Conn: conn, server: w.server}
+	w.server.addTunnel(tracked)
+	return tracked, rw, nil
+}
+
+func (w *trackingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type trackedConn struct {
+	net.Conn
+	server *Server
+}
+
+func (c *trackedConn) Close() error {
+	c.server.removeTunnel(c)
+	return c.Conn.Close()
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startServer serves handler on a random local port and returns its address.
+func startServer(t *testing.T, handler http.Handler, config Config) (*Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", handler, config)
+	go s.Serve(listener)
+	return s, "http://" + listener.Addr().String()
+}
+
+// client does not keep idle connections, so that they do not delay the
+// shutdowns.
+var client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReadinessFailsDuringPreStopDelay(t *testing.T) {
+	s, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		Config{PreStopDelay: 1, DrainTimeout: 1})
+
+	if status := getStatus(t, url+defaultReadinessPath); status != http.StatusOK {
+		t.Fatalf("expected the server to be ready, got %d", status)
+	}
+
+	done := make(chan Summary)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	if status := getStatus(t, url+defaultReadinessPath); status != http.StatusServiceUnavailable {
+		t.Errorf("expected the readiness endpoint to fail, got %d", status)
+	}
+	// the requests are still served until the pre-stop delay is over.
+	if status := getStatus(t, url+"/"); status != http.StatusOK {
+		t.Errorf("expected the request to be served during the pre-stop delay, got %d", status)
+	}
+
+	summary := <-done
+	if !summary.Drained || summary.Duration < time.Second {
+		t.Errorf("expected a drained shutdown after the pre-stop delay, got %+v", summary)
+	}
+	if _, err := client.Get(url + "/"); err == nil {
+		t.Error("expected the server to stop accepting connections")
+	}
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	s, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		_, _ = fmt.Fprint(w, "done")
+	}), Config{DrainTimeout: 5})
+
+	result := make(chan int)
+	go func() {
+		resp, err := client.Get(url + "/slow")
+		if err != nil {
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	<-started
+
+	summary := s.Shutdown(context.Background())
+	if status := <-result; status != http.StatusOK {
+		t.Errorf("expected the in-flight request to finish, got %d", status)
+	}
+	if !summary.Drained || summary.ForceClosedRequests != 0 {
+		t.Errorf("expected a drained shutdown, got %+v", summary)
+	}
+}
+
+func TestShutdownForceClosesAfterDrainTimeout(t *testing.T) {
+	started := make(chan struct{}, 2)
+	s, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tunnel" {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			_ = rw.Flush()
+			started <- struct{}{}
+			// the tunnel stays open until the client or the server closes it.
+			_, _ = conn.Read(make([]byte, 1))
+			return
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+	}), Config{DrainTimeout: 1})
+
+	conn, err := net.Dial("tcp", url[len("http://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprint(conn, "GET /tunnel HTTP/1.1\r\nHost: yalp\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("could not open the tunnel: %v", err)
+	}
+	go func() {
+		resp, err := client.Get(url + "/hanging")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	<-started
+
+	summary := s.Shutdown(context.Background())
+	if summary.Drained || summary.ForceClosedTunnels != 1 || summary.ForceClosedRequests != 1 {
+		t.Errorf("expected one tunnel and one request to be force-closed, got %+v", summary)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the tunnel to be closed")
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the names of the listeners passed to the new process, in the order of
+	// their file descriptors.
+	listenersEnv = "YALP_LISTENERS"
+	// the file descriptor the new process writes to once it is ready.
+	readyFdEnv = "YALP_READY_FD"
+	// the first file descriptor after stdin, stdout and stderr.
+	listenFdsStart = 3
+)
+
+// Upgrader hands the listeners of the running process over to a new process
+// of the same binary, so that a new version can be deployed without refusing
+// a single connection. Both processes accept connections on the same sockets
+// until the old one drains and exits.
+type Upgrader struct {
+	mu        sync.Mutex
+	names     []string
+	listeners map[string]net.Listener
+	// the listeners passed by the previous process that were not used yet.
+	inherited map[string]*os.File
+	ready     *os.File
+	upgrading bool
+
+	// the command of the new process, os.Args by default.
+	args []string
+}
+
+// NewUpgrader constructs an Upgrader, taking over the listeners of the
+// previous process if this one was started by an upgrade.
+func NewUpgrader() (*Upgrader, error) {
+	u := &Upgrader{
+		listeners: make(map[string]net.Listener),
+		inherited: make(map[string]*os.File),
+		args:      os.Args,
+	}
+	if names := os.Getenv(listenersEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			u.inherited[name] = os.NewFile(uintptr(listenFdsStart+i), name)
+		}
+	}
+	if fd := os.Getenv(readyFdEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s: %s", readyFdEnv, fd))
+		}
+		u.ready = os.NewFile(uintptr(n), "ready")
+	}
+	// the next upgrade sets its own variables.
+	_ = os.Unsetenv(listenersEnv)
+	_ = os.Unsetenv(readyFdEnv)
+	return u, nil
+}
+
+// Upgraded reports whether the process was started by an upgrade.
+func (u *Upgrader) Upgraded() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ready != nil
+}
+
+// Listen returns the listener with the given name passed by the previous
+// process, or calls listen if there is none. The listener is passed to the
+// next process on upgrade.
+func (u *Upgrader) Listen(name string, listen func() (net.Listener, error)) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.listeners[name]; ok {
+		return nil, errors.New(fmt.Sprintf("the listener %s already exists", name))
+	}
+
+	var listener net.Listener
+	var err error
+	if file, ok := u.inherited[name]; ok {
+		delete(u.inherited, name)
+		listener, err = net.FileListener(file)
+		_ = file.Close()
+		// the socket file belongs to this process now, it is removed when the
+		// listener is closed unless it is passed on again.
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(true)
+		}
+	} else {
+		listener, err = listen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.names = append(u.names, name)
+	u.listeners[name] = listener
+	return listener, nil
+}
+
+// Ready tells the previous process that this one is serving, so that it can
+// drain and exit. It does nothing if the process was not started by an
+// upgrade.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// the listeners that were not taken over are closed, the previous process
+	// closes its own.
+	for name, file := range u.inherited {
+		_ = file.Close()
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	closeErr := u.ready.Close()
+	u.ready = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade starts a new process of the same binary with the listeners and
+// waits for it to be ready. Once it returns without an error the caller
+// should drain its connections and exit. If the new process fails or is not
+// ready within timeout, it is killed and the current process keeps serving.
+func (u *Upgrader) Upgrade(timeout time.Duration) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.upgrading {
+		return errors.New("an upgrade is already in progress")
+	}
+	if u.ready != nil {
+		return errors.New("the process is not ready yet")
+	}
+	u.upgrading = true
+
+	err := u.startNewProcess(timeout)
+	if err != nil {
+		u.upgrading = false
+		return err
+	}
+	// the sockets now belong to the new process as well, closing them here
+	// must not remove their files.
+	for _, listener := range u.listeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+func (u *Upgrader) startNewProcess(timeout time.Duration) error {
+	files := make([]*os.File, 0, len(u.names)+1)
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	for _, name := range u.names {
+		listener, ok := u.listeners[name].(filer)
+		if !ok {
+			return errors.New(fmt.Sprintf("the listener %s cannot be passed to a new process", name))
+		}
+		file, err := listener.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(u.args[0], u.args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(u.names, ","),
+		readyFdEnv+"="+strconv.Itoa(listenFdsStart+len(files)-1))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// only the new process may write to the pipe, so that reading it fails
+	// once the new process exits.
+	_ = readyWriter.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = errors.New(fmt.Sprintf("the new process exited before it was ready: %s", err))
+		}
+	case <-time.After(timeout):
+		err = errors.New(fmt.Sprintf("the new process was not ready after %s", timeout))
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	// the new process is not a child to wait for, it outlives this one.
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
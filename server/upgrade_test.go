@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const upgradeChildEnv = "YALP_TEST_UPGRADE_CHILD"
+
+func getBody(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestUpgradeHandsOverListener(t *testing.T) {
+	upgrader, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := upgrader.Listen("proxy", func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+	parent := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "parent")
+	})}
+	go parent.Serve(listener)
+	defer parent.Close()
+
+	if body := getBody(t, url); body != "parent" {
+		t.Fatalf("expected the parent to serve the request, got %q", body)
+	}
+
+	t.Setenv(upgradeChildEnv, "1")
+	upgrader.args = []string{os.Args[0], "-test.run=^TestUpgradeChild$"}
+	if err := upgrader.Upgrade(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := upgrader.Upgrade(10 * time.Second); err == nil {
+		t.Error("expected a second upgrade to be refused")
+	}
+	// both processes accept connections until the parent drains.
+	_ = parent.Close()
+
+	if body := getBody(t, url); body != "child" {
+		t.Errorf("expected the child to serve the request, got %q", body)
+	}
+	getBody(t, url+"/exit")
+}
+
+// TestUpgradeChild is the new process started by TestUpgradeHandsOverListener.
+func TestUpgradeChild(t *testing.T) {
+	if os.Getenv(upgradeChildEnv) == "" {
+		t.Skip("only runs as the new process of an upgrade")
+	}
+	upgrader, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upgrader.Upgraded() {
+		t.Fatal("expected the process to be started by an upgrade")
+	}
+	listener, err := upgrader.Listen("proxy", func() (net.Listener, error) {
+		return nil, errors.New("expected the listener of the parent")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exit := make(chan struct{})
+	var once sync.Once
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/exit" {
+			once.Do(func() { close(exit) })
+		}
+		_, _ = fmt.Fprint(w, "child")
+	}))
+	if err := upgrader.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exit:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+func TestFailedUpgradeKeepsServing(t *testing.T) {
+	upgrader, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := upgrader.Listen("proxy", func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// without the environment variable the child skips, so it exits without
+	// being ready.
+	upgrader.args = []string{os.Args[0], "-test.run=^TestUpgradeChild$"}
+	if err := upgrader.Upgrade(10 * time.Second); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	// a failed upgrade can be retried.
+	if err := upgrader.Upgrade(10 * time.Second); err == nil {
+		t.Fatal("expected the upgrade to fail again")
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err != nil {
+		t.Errorf("expected the listener to stay open: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEndpoint = "http://localhost:4318/v1/traces"
+	// the maximum number of finished spans waiting to be exported, spans
+	// that do not fit are dropped.
+	maxQueueSize = 2048
+	// the maximum number of spans sent in one request to the collector.
+	maxBatchSize = 512
+)
+
+// exporter sends finished spans to an OTLP collector using the OTLP/HTTP
+// JSON encoding.
+// See here: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type exporter struct {
+	endpoint      string
+	serviceName   string
+	flushInterval time.Duration
+	client        *http.Client
+	spans         chan *Span
+	stop          chan struct{}
+	done          chan struct{}
+	stopOnce      sync.Once
+}
+
+func newExporter(endpoint string, serviceName string, flushInterval time.Duration) *exporter {
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	e := &exporter{
+		endpoint:      endpoint,
+		serviceName:   serviceName,
+		flushInterval: flushInterval,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		spans:         make(chan *Span, maxQueueSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		// the queue is full, dropping the span is better than blocking requests.
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Print("could not export spans: ", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+					if len(batch) >= maxBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) shutdown(ctx context.Context) error {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("the collector responded with %s", resp.Status))
+	}
+	return nil
+}
+
+// The types below mirror the OTLP JSON encoding of an ExportTraceServiceRequest.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *exporter) encode(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.Lock()
+		s := otlpSpan{
+			TraceID:           span.context.TraceID.String(),
+			SpanID:            span.context.SpanID.String(),
+			TraceState:        span.context.TraceState,
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Status: otlpStatus{
+				Code:    span.status,
+				Message: span.statusMessage,
+			},
+		}
+		if span.parentID.IsValid() {
+			s.ParentSpanID = span.parentID.String()
+		}
+		for _, a := range span.attributes {
+			s.Attributes = append(s.Attributes, encodeAttribute(a.key, a.value))
+		}
+		span.Unlock()
+		encoded = append(encoded, s)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{encodeAttribute("service.name", e.serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/alidn/Yalp/tracing"},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
+
+func encodeAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
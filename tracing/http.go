@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Handler wraps next so that every request gets a server span. The span
+// continues the trace of the incoming traceparent header if there is one,
+// otherwise it starts a new trace.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tracer := GetTracer()
+		if tracer == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		if sc, ok := Extract(req.Header); ok {
+			ctx = ContextWithRemoteSpanContext(ctx, sc)
+		}
+		ctx, span := tracer.Start(ctx, "yalp.request", SpanKindServer)
+		defer span.End()
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.RequestURI())
+		span.SetAttribute("http.host", req.Host)
+		span.SetAttribute("net.peer.addr", req.RemoteAddr)
+
+		recorder := NewStatusRecorder(w)
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", recorder.Status())
+		if recorder.Status() >= http.StatusInternalServerError {
+			span.SetStatus(StatusError, http.StatusText(recorder.Status()))
+		}
+	})
+}
+
+// StatusRecorder remembers the status code written by the wrapped handler.
+// It can still be flushed and hijacked if the ResponseWriter it wraps can.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// NewStatusRecorder wraps w, the status is 200 until the handler writes
+// another one.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Status returns the status code written by the handler.
+func (r *StatusRecorder) Status() int {
+	return r.status
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Transport is an http.RoundTripper that creates a client span for every
+// upstream attempt and propagates it to the backend using the traceparent
+// header.
+type Transport struct {
+	// Base is the RoundTripper used to make the requests. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tracer := GetTracer()
+	if tracer == nil {
+		return t.base().RoundTrip(req)
+	}
+
+	ctx, span := tracer.Start(req.Context(), "yalp.upstream", SpanKindClient)
+	defer span.End()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+	span.SetAttribute("net.peer.name", req.URL.Host)
+
+	outReq := req.WithContext(ctx)
+	outReq.Header = req.Header.Clone()
+	Inject(outReq.Header, span.SpanContext())
+
+	resp, err := t.base().RoundTrip(outReq)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(StatusError, resp.Status)
+	}
+	return resp, nil
+}
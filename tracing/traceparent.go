@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader is the W3C Trace Context header that carries the trace
+// id, the parent span id and the trace flags.
+// See here: https://www.w3.org/TR/trace-context/#traceparent-header
+const TraceparentHeader = "traceparent"
+
+// TracestateHeader is the W3C Trace Context header that carries vendor
+// specific trace data. Yalp does not interpret it, it only forwards it.
+const TracestateHeader = "tracestate"
+
+const sampledFlag byte = 0x01
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of a span that is propagated between processes.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	TraceFlags byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.TraceFlags&sampledFlag == sampledFlag
+}
+
+// Traceparent returns the value of the traceparent header for the span
+// context, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.TraceFlags)
+}
+
+// ParseTraceparent parses the value of a traceparent header. It returns an
+// error if the value is malformed or contains an all-zero trace or span id.
+func ParseTraceparent(value string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, errors.New(fmt.Sprintf("malformed traceparent: %q", value))
+	}
+	version, err := decodeHex(parts[0], 1)
+	if err != nil || version[0] == 0xff {
+		return sc, errors.New(fmt.Sprintf("invalid traceparent version: %q", value))
+	}
+	// version 00 has exactly four fields, future versions may append more.
+	if version[0] == 0 && len(parts) != 4 {
+		return sc, errors.New(fmt.Sprintf("malformed traceparent: %q", value))
+	}
+	traceID, err := decodeHex(parts[1], len(sc.TraceID))
+	if err != nil {
+		return sc, errors.New(fmt.Sprintf("invalid trace id in traceparent: %q", value))
+	}
+	spanID, err := decodeHex(parts[2], len(sc.SpanID))
+	if err != nil {
+		return sc, errors.New(fmt.Sprintf("invalid parent id in traceparent: %q", value))
+	}
+	flags, err := decodeHex(parts[3], 1)
+	if err != nil {
+		return sc, errors.New(fmt.Sprintf("invalid trace flags in traceparent: %q", value))
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.TraceFlags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New(fmt.Sprintf("all-zero id in traceparent: %q", value))
+	}
+	return sc, nil
+}
+
+// decodeHex decodes a lowercase hex string of exactly n bytes.
+func decodeHex(s string, n int) ([]byte, error) {
+	if len(s) != 2*n || strings.ToLower(s) != s {
+		return nil, errors.New("unexpected length or case")
+	}
+	return hex.DecodeString(s)
+}
+
+// Extract reads the span context from the traceparent and tracestate headers.
+// The second return value is false if there is no valid traceparent.
+func Extract(header http.Header) (SpanContext, bool) {
+	value := header.Get(TraceparentHeader)
+	if value == "" {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(value)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.TraceState = header.Get(TracestateHeader)
+	return sc, true
+}
+
+// Inject writes the span context into the traceparent and tracestate headers,
+// replacing any existing values.
+func Inject(header http.Header, sc SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	header.Set(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		header.Set(TracestateHeader, sc.TraceState)
+	} else {
+		header.Del(TracestateHeader)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Config holds the tracing settings.
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// the OTLP/HTTP traces endpoint of the collector,
+	// e.g. http://localhost:4318/v1/traces.
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+	// how often the buffered spans are sent to the collector, in milliseconds.
+	FlushInterval int `yaml:"flush_interval"`
+}
+
+const defaultServiceName = "yalp"
+
+type SpanKind int
+
+// The span kinds as defined by OTLP.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+type StatusCode int
+
+// The span status codes as defined by OTLP.
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Tracer creates spans and hands the finished ones to the OTLP exporter.
+// A nil *Tracer is valid and creates no spans.
+type Tracer struct {
+	serviceName string
+	exporter    *exporter
+}
+
+// NewTracer constructs a Tracer that exports to the collector configured in
+// config. It returns nil if tracing is disabled.
+func NewTracer(config Config) *Tracer {
+	if !config.Enabled {
+		return nil
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	flushInterval := time.Duration(config.FlushInterval) * time.Millisecond
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+	return &Tracer{
+		serviceName: serviceName,
+		exporter:    newExporter(config.Endpoint, serviceName, flushInterval),
+	}
+}
+
+// Start starts a new span as a child of the span stored in ctx, or of the
+// remote span context stored with ContextWithRemoteSpanContext. If there is
+// no parent, a new trace is started.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent.IsValid() {
+		span.parentID = parent.SpanID
+		span.context = SpanContext{
+			TraceID:    parent.TraceID,
+			SpanID:     newSpanID(),
+			TraceFlags: parent.TraceFlags,
+			TraceState: parent.TraceState,
+		}
+	} else {
+		span.context = SpanContext{
+			TraceID:    newTraceID(),
+			SpanID:     newSpanID(),
+			TraceFlags: sampledFlag,
+		}
+	}
+	return context.WithValue(ctx, spanContextKey{}, span.context), span
+}
+
+// Shutdown sends the buffered spans to the collector and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.shutdown(ctx)
+}
+
+type spanContextKey struct{}
+
+// SpanContextFromContext returns the span context stored in ctx, or an
+// invalid span context if there is none.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// ContextWithRemoteSpanContext returns a copy of ctx that carries a span
+// context received from another process, so that spans started from it
+// become its children.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// Span is a single timed operation in a trace. All the methods are safe to
+// call on a nil *Span.
+type Span struct {
+	tracer        *Tracer
+	name          string
+	kind          SpanKind
+	context       SpanContext
+	parentID      SpanID
+	start         time.Time
+	end           time.Time
+	attributes    []attribute
+	status        StatusCode
+	statusMessage string
+	ended         bool
+	sync.Mutex
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// SpanContext returns the span context to propagate to other processes.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a string, bool, int or float64 attribute on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// SetStatus sets the status of the span.
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.status = code
+	s.statusMessage = message
+}
+
+// RecordError marks the span as failed with the given error.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End finishes the span and queues it for export. Calling End more than once
+// has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.Unlock()
+
+	if s.context.IsSampled() {
+		s.tracer.exporter.export(s)
+	}
+}
+
+var globalTracer struct {
+	tracer *Tracer
+	sync.RWMutex
+}
+
+// SetTracer sets the tracer used by Start. Passing nil disables tracing.
+func SetTracer(t *Tracer) {
+	globalTracer.Lock()
+	defer globalTracer.Unlock()
+	globalTracer.tracer = t
+}
+
+// GetTracer returns the tracer set with SetTracer, or nil.
+func GetTracer() *Tracer {
+	globalTracer.RLock()
+	defer globalTracer.RUnlock()
+	return globalTracer.tracer
+}
+
+// Start starts a span using the tracer set with SetTracer.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return GetTracer().Start(ctx, name, kind)
+}
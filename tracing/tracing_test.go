@@ -0,0 +1,141 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(valid)
+	if err != nil {
+		t.Fatalf("expected %q to be valid, got %v", valid, err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace id %s", sc.TraceID)
+	}
+	if sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("unexpected span id %s", sc.SpanID)
+	}
+	if !sc.IsSampled() {
+		t.Errorf("expected the span context to be sampled")
+	}
+	if sc.Traceparent() != valid {
+		t.Errorf("expected %q, received %q", valid, sc.Traceparent())
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, value := range invalid {
+		if _, err := ParseTraceparent(value); err == nil {
+			t.Errorf("expected %q to be invalid", value)
+		}
+	}
+}
+
+// collector is a stand-in for an OTLP/HTTP collector that records the spans
+// it receives.
+type collector struct {
+	spans []otlpSpan
+	sync.Mutex
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := otlpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+}
+
+func (c *collector) find(name string) (otlpSpan, bool) {
+	c.Lock()
+	defer c.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span, true
+		}
+	}
+	return otlpSpan{}, false
+}
+
+func TestPropagatesAndExportsSpans(t *testing.T) {
+	stub := &collector{}
+	collectorServer := httptest.NewServer(stub)
+	defer collectorServer.Close()
+
+	var receivedTraceparent string
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedTraceparent = r.Header.Get(TraceparentHeader)
+	}))
+	defer backendServer.Close()
+
+	tracer := NewTracer(Config{Enabled: true, Endpoint: collectorServer.URL, FlushInterval: 10})
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	backendURL, _ := url.Parse(backendServer.URL)
+	proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	proxy.Transport = &Transport{}
+	proxyServer := httptest.NewServer(Handler(proxy))
+	defer proxyServer.Close()
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+	req.Header.Set(TraceparentHeader, incoming)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	propagated, err := ParseTraceparent(receivedTraceparent)
+	if err != nil {
+		t.Fatalf("expected the backend to receive a valid traceparent, got %q", receivedTraceparent)
+	}
+	if propagated.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the backend to receive the incoming trace id, got %s", propagated.TraceID)
+	}
+
+	serverSpan, ok := stub.find("yalp.request")
+	if !ok {
+		t.Fatal("expected the collector to receive the server span")
+	}
+	if serverSpan.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("expected the server span to be a child of the incoming span, got parent %q", serverSpan.ParentSpanID)
+	}
+	clientSpan, ok := stub.find("yalp.upstream")
+	if !ok {
+		t.Fatal("expected the collector to receive the upstream span")
+	}
+	if clientSpan.ParentSpanID != serverSpan.SpanID {
+		t.Errorf("expected the upstream span to be a child of the server span")
+	}
+	if clientSpan.SpanID != propagated.SpanID.String() {
+		t.Errorf("expected the backend to receive the upstream span id %s, got %s", clientSpan.SpanID, propagated.SpanID)
+	}
+}